@@ -0,0 +1,244 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalSyntax(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		offset int64 // Expected error offset, -1 if the input is valid
+	}{
+		{"integer", "i42e", -1},
+		{"negative integer", "i-42e", -1},
+		{"zero", "i0e", -1},
+		{"leading zero", "i03e", 1},
+		{"negative leading zero", "i-03e", 1},
+		{"negative zero", "i-0e", 1},
+		{"empty integer", "ie", 1},
+		{"string", "3:abc", -1},
+		{"empty string", "0:", -1},
+		{"string length leading zero", "03:abc", 0},
+		{"negative string length", "-3:abc", 0},
+		{"short string", "5:abc", 0},
+		{"huge string length", "d1:t100000000:e", 4},
+		{"sorted keys", "d1:ai1e1:bi2ee", -1},
+		{"unsorted keys", "d1:bi1e1:ai2ee", 7},
+		{"duplicate keys", "d1:ai1e1:ai2ee", 7},
+		{"non-string key", "di1ei2ee", 1},
+		{"unterminated list", "li1e", 4},
+		{"trailing data", "i1ei2e", 3},
+		{"invalid start", "x", 0},
+		{"too deep", strings.Repeat("l", maxDepth+1) + strings.Repeat("e", maxDepth+1), maxDepth},
+		{"deep but allowed", strings.Repeat("l", maxDepth) + strings.Repeat("e", maxDepth), -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v any
+			err := Unmarshal([]byte(tt.input), &v)
+
+			if tt.offset < 0 {
+				if err != nil {
+					t.Fatalf("Unmarshal(%q) = %v, want no error", tt.input, err)
+				}
+				return
+			}
+
+			var se *SyntaxError
+			if !errors.As(err, &se) {
+				t.Fatalf("Unmarshal(%q) = %v, want a SyntaxError", tt.input, err)
+			}
+			if se.Offset != tt.offset {
+				t.Errorf("Unmarshal(%q) error at offset %d, want %d (%v)", tt.input, se.Offset, tt.offset, err)
+			}
+		})
+	}
+}
+
+func TestAllowUnsortedKeys(t *testing.T) {
+	tests := []struct {
+		input string
+		ok    bool
+	}{
+		{"d1:bi1e1:ai2ee", true},
+		{"d1:ai1e1:ai2ee", false}, // Duplicates are never allowed
+		{"d1:xd1:bi1e1:ai2eee", true},
+		{"d1:bi1e1:ai2e1:bi3ee", false}, // Not next to each other
+		{"d4:infod1:xi1ee1:a1:b4:infod1:xi2eee", false},
+		{"d1:xd1:bi1e1:ai2e1:bi3eee", false},
+	}
+
+	for _, tt := range tests {
+		d := NewDecoder(strings.NewReader(tt.input))
+		d.AllowUnsortedKeys()
+
+		var v map[string]any
+		if err := d.Decode(&v); (err == nil) != tt.ok {
+			t.Errorf("lenient Decode(%q) = %v, want ok = %v", tt.input, err, tt.ok)
+		}
+
+		// Same through a struct, where unknown keys are skipped
+		d = NewDecoder(strings.NewReader(tt.input))
+		d.AllowUnsortedKeys()
+
+		var st struct {
+			Info RawMessage `bencode:"info"`
+		}
+		if err := d.Decode(&st); (err == nil) != tt.ok {
+			t.Errorf("lenient Decode(%q) into a struct = %v, want ok = %v", tt.input, err, tt.ok)
+		}
+	}
+}
+
+func TestStreamLongString(t *testing.T) {
+	s := strings.Repeat("x", 3*readChunkSize+5)
+	input := "d1:s" + strconv.Itoa(len(s)) + ":" + s + "e"
+
+	var v struct {
+		S string `bencode:"s"`
+	}
+	if err := NewDecoder(strings.NewReader(input)).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.S != s {
+		t.Errorf("decoded string of length %d, want %d", len(v.S), len(s))
+	}
+
+	// A stream that ends early fails without allocating the declared length
+	var w any
+	if err := NewDecoder(strings.NewReader("100000000:abc")).Decode(&w); err == nil {
+		t.Error("Decode of a truncated string succeeded")
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	input := "d4:infod6:lengthi5e4:name1:ae3:keyi1ee"
+
+	var v struct {
+		Info RawMessage `bencode:"info"`
+		Key  int        `bencode:"key"`
+	}
+	if err := Unmarshal([]byte(input), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "d6:lengthi5e4:name1:ae"; string(v.Info) != want {
+		t.Errorf("raw info = %q, want %q", v.Info, want)
+	}
+	if v.Key != 1 {
+		t.Errorf("key = %d, want 1", v.Key)
+	}
+
+	out, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != input {
+		t.Errorf("Marshal = %q, want %q", out, input)
+	}
+}
+
+type rawMarshaler string
+
+func (m rawMarshaler) MarshalBencode() ([]byte, error) {
+	return []byte(m), nil
+}
+
+func TestMarshalerValidation(t *testing.T) {
+	tests := []struct {
+		output string
+		ok     bool
+	}{
+		{"i1e", true},
+		{"d1:ai1ee", true},
+		{"i03e", false},
+		{"d1:bi1e1:ai2ee", false},
+		{"i1ei2e", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		_, err := Marshal(map[string]any{"v": rawMarshaler(tt.output)})
+		if tt.ok && err != nil {
+			t.Errorf("Marshal of %q = %v, want no error", tt.output, err)
+		}
+
+		var me *MarshalerError
+		if !tt.ok && !errors.As(err, &me) {
+			t.Errorf("Marshal of %q = %v, want a MarshalerError", tt.output, err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	type inner struct {
+		N int    `bencode:"n"`
+		B []byte `bencode:"b,omitempty"`
+	}
+	type outer struct {
+		Z     string         `bencode:"z"`
+		A     []inner        `bencode:"a"`
+		M     map[string]int `bencode:"m"`
+		Empty string         `bencode:"empty,omitempty"`
+	}
+
+	in := outer{Z: "last", A: []inner{{N: -1}, {N: 2, B: []byte{0, 1}}}, M: map[string]int{"y": 1, "x": 2}}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "d1:ald1:ni-1eed1:b2:\x00\x011:ni2eee1:md1:xi2e1:yi1ee1:z4:laste"
+	if string(data) != want {
+		t.Fatalf("Marshal = %q, want %q", data, want)
+	}
+
+	out := outer{}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Z != in.Z || len(out.A) != 2 || !bytes.Equal(out.A[1].B, in.A[1].B) || out.M["x"] != 2 {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+}
+
+func TestVerbatimMessage(t *testing.T) {
+	tests := []struct {
+		info string
+		ok   bool
+	}{
+		{"d1:ai1e1:bi2ee", true},
+		{"d1:bi1e1:ai2ee", true}, // Kept as is, not sorted
+		{"d1:bi1e1:ai2e1:bi3ee", false},
+		{"d1:ai1e", false},
+		{"i1ei2e", false},
+	}
+
+	for _, tt := range tests {
+		v := struct {
+			Info VerbatimMessage `bencode:"info"`
+		}{VerbatimMessage(tt.info)}
+
+		out, err := Marshal(v)
+		if (err == nil) != tt.ok {
+			t.Errorf("Marshal(%q) = %v, want ok = %v", tt.info, err, tt.ok)
+			continue
+		}
+		if want := "d4:info" + tt.info + "e"; tt.ok && string(out) != want {
+			t.Errorf("Marshal(%q) = %q, want %q", tt.info, out, want)
+		}
+	}
+
+	// A RawMessage still has to be canonical
+	if _, err := Marshal(struct {
+		Info RawMessage `bencode:"info"`
+	}{RawMessage("d1:bi1e1:ai2ee")}); err == nil {
+		t.Error("RawMessage with unsorted keys was encoded")
+	}
+}
@@ -0,0 +1,653 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+const (
+	// Strings longer than this are rejected before allocating them.
+	maxStringLength = 128 * 1024 * 1024
+
+	// Strings are read in chunks of this size, so a declared length
+	// doesn't allocate more than the input actually holds.
+	readChunkSize = 64 * 1024
+
+	// Lists and dictionaries nested deeper than this are rejected.
+	maxDepth = 512
+)
+
+var (
+	unmarshalerType = reflect.TypeFor[Unmarshaler]()
+)
+
+// A Decoder reads bencoded values from a stream.
+// It is strict by default: besides malformed input it rejects anything
+// that is not canonical, such as unsorted or duplicate dictionary keys,
+// leading zeros and negative zero.
+type Decoder struct {
+	r       *bufio.Reader
+	offset  int64
+	size    int64 // Length of the input if known, -1 for streams
+	depth   int   // Lists and dictionaries currently open
+	lenient bool
+
+	// Bytes read while capturing raw values (RawMessage, Unmarshaler)
+	rec       []byte
+	recording int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br, size: -1}
+}
+
+// AllowUnsortedKeys makes the decoder accept dictionaries whose keys are
+// not sorted, as sent by some trackers. Duplicate keys are still rejected.
+func (d *Decoder) AllowUnsortedKeys() {
+	d.lenient = true
+}
+
+// Offset returns the number of bytes consumed from the input so far.
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// Decode reads the next bencoded value from the input and stores it in v,
+// which MUST be a non-nil pointer. Returns io.EOF if the input is exhausted.
+func (d *Decoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("bencode: Decode requires a non-nil pointer")
+	}
+
+	if _, err := d.r.Peek(1); err == io.EOF {
+		return io.EOF
+	}
+	return d.value(rv.Elem())
+}
+
+// Unmarshal decodes the single bencoded value in data into v.
+// Trailing bytes after the value are an error.
+func Unmarshal(data []byte, v any) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.size = int64(len(data))
+	if err := d.Decode(v); err != nil {
+		if err == io.EOF {
+			return d.errorf("unexpected end of input")
+		}
+		return err
+	}
+
+	if d.offset != int64(len(data)) {
+		return d.errorf("trailing data after value")
+	}
+	return nil
+}
+
+// Valid reports whether data is a single canonical bencoded value.
+func Valid(data []byte) error {
+	return valid(data, false)
+}
+
+// Check that data is a single value, allowing unsorted dictionary keys
+// if `lenient` is set.
+func valid(data []byte, lenient bool) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.size = int64(len(data))
+	d.lenient = lenient
+	if err := d.skip(); err != nil {
+		return err
+	}
+
+	if d.offset != int64(len(data)) {
+		return d.errorf("trailing data after value")
+	}
+	return nil
+}
+
+func (d *Decoder) errorf(format string, args ...any) error {
+	return &SyntaxError{Offset: d.offset, msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *Decoder) typeError(value string, t reflect.Type, offset int64) error {
+	return &UnmarshalTypeError{Value: value, Type: t, Offset: offset}
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return 0, d.errorf("unexpected end of input")
+		}
+		return 0, err
+	}
+
+	d.offset++
+	if d.recording > 0 {
+		d.rec = append(d.rec, c)
+	}
+	return c, nil
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return 0, d.errorf("unexpected end of input")
+		}
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Read n bytes. Large strings grow in chunks as their data arrives,
+// so a length prefix alone can't make us allocate much.
+func (d *Decoder) readBytes(n int) ([]byte, error) {
+	buf := make([]byte, 0, min(n, readChunkSize))
+
+	for len(buf) < n {
+		chunk := min(n-len(buf), readChunkSize)
+		buf = append(buf, make([]byte, chunk)...)
+
+		read, err := io.ReadFull(d.r, buf[len(buf)-chunk:])
+		d.offset += int64(read)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, d.errorf("unexpected end of input in string")
+			}
+			return nil, err
+		}
+	}
+
+	if d.recording > 0 {
+		d.rec = append(d.rec, buf...)
+	}
+	return buf, nil
+}
+
+// Read the digits of an integer up to the terminator byte.
+// Only the canonical form is accepted: no leading zeros, no "-0".
+func (d *Decoder) readDigits(term byte, allowNegative bool) (string, error) {
+	start := d.offset
+	digits := []byte{}
+
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+
+		if c == term {
+			break
+		}
+
+		switch {
+		case c == '-' && allowNegative && len(digits) == 0:
+		case c >= '0' && c <= '9':
+		default:
+			return "", d.errorf("unexpected byte %q in integer", c)
+		}
+		digits = append(digits, c)
+	}
+
+	s := string(digits)
+	switch {
+	case s == "" || s == "-":
+		return "", &SyntaxError{Offset: start, msg: "empty integer"}
+	case s == "-0":
+		return "", &SyntaxError{Offset: start, msg: "negative zero"}
+	case s[0] == '0' && len(s) > 1, len(s) > 2 && s[:2] == "-0":
+		return "", &SyntaxError{Offset: start, msg: "leading zero in number"}
+	}
+	return s, nil
+}
+
+// Read an integer value (`i<digits>e`) and return its digits.
+func (d *Decoder) readInteger() (string, error) {
+	if c, err := d.readByte(); err != nil {
+		return "", err
+	} else if c != 'i' {
+		return "", d.errorf("expected integer, got %q", c)
+	}
+	return d.readDigits('e', true)
+}
+
+// Read a string value (`<length>:<bytes>`).
+func (d *Decoder) readString() ([]byte, error) {
+	start := d.offset
+
+	digits, err := d.readDigits(':', false)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(digits)
+	if err != nil || n > maxStringLength {
+		return nil, &SyntaxError{Offset: start, msg: "string length out of range"}
+	}
+	if d.size >= 0 && int64(n) > d.size-d.offset {
+		return nil, &SyntaxError{Offset: start, msg: "string longer than the input"}
+	}
+	return d.readBytes(n)
+}
+
+// Enter a list or dictionary, failing if they nest too deep.
+func (d *Decoder) enter() error {
+	if d.depth >= maxDepth {
+		return d.errorf("nested deeper than %d levels", maxDepth)
+	}
+	d.depth++
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// dictKeys tracks the keys of a dictionary being read.
+type dictKeys struct {
+	prev []byte
+	read bool            // Whether prev holds a key yet
+	seen map[string]bool // Every key read so far, only kept when unsorted keys are allowed
+}
+
+// Check that a dictionary key comes after the previous one, or only that
+// it wasn't seen before when unsorted keys are allowed.
+func (d *Decoder) checkKey(k *dictKeys, key []byte, offset int64) error {
+	if d.lenient {
+		if k.seen == nil {
+			k.seen = map[string]bool{}
+		}
+		if k.seen[string(key)] {
+			return &SyntaxError{Offset: offset, msg: fmt.Sprintf("duplicate dictionary key %q", key)}
+		}
+		k.seen[string(key)] = true
+		return nil
+	}
+
+	if k.read {
+		switch cmp := bytes.Compare(k.prev, key); {
+		case cmp == 0:
+			return &SyntaxError{Offset: offset, msg: fmt.Sprintf("duplicate dictionary key %q", key)}
+		case cmp > 0:
+			return &SyntaxError{Offset: offset, msg: fmt.Sprintf("dictionary key %q is not sorted", key)}
+		}
+	}
+	k.prev, k.read = key, true
+	return nil
+}
+
+// Read and validate a value without storing it.
+func (d *Decoder) skip() error {
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == 'i':
+		_, err := d.readInteger()
+		return err
+
+	case c >= '0' && c <= '9':
+		_, err := d.readString()
+		return err
+
+	case c == 'l':
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+
+		d.readByte()
+		for {
+			if c, err := d.peekByte(); err != nil {
+				return err
+			} else if c == 'e' {
+				d.readByte()
+				return nil
+			}
+
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+
+	case c == 'd':
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+
+		d.readByte()
+		var keys dictKeys
+		for {
+			if c, err := d.peekByte(); err != nil {
+				return err
+			} else if c == 'e' {
+				d.readByte()
+				return nil
+			}
+
+			offset := d.offset
+			key, err := d.readDictKey()
+			if err != nil {
+				return err
+			}
+
+			if err := d.checkKey(&keys, key, offset); err != nil {
+				return err
+			}
+
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return d.errorf("invalid value start %q", c)
+	}
+}
+
+func (d *Decoder) readDictKey() ([]byte, error) {
+	c, err := d.peekByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if c < '0' || c > '9' {
+		return nil, d.errorf("dictionary key is not a string")
+	}
+	return d.readString()
+}
+
+// Read the exact bytes of the next value, validating it on the way.
+func (d *Decoder) readRaw() ([]byte, error) {
+	start := len(d.rec)
+	d.recording++
+
+	err := d.skip()
+
+	d.recording--
+	raw := append([]byte(nil), d.rec[start:]...)
+	if d.recording == 0 {
+		d.rec = d.rec[:0]
+	}
+	return raw, err
+}
+
+// Find an Unmarshaler implemented by v or by a pointer to v.
+func unmarshalerOf(v reflect.Value) (Unmarshaler, bool) {
+	if v.Kind() != reflect.Pointer && v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+		return v.Addr().Interface().(Unmarshaler), true
+	}
+
+	if v.Kind() == reflect.Pointer && v.Type().Implements(unmarshalerType) {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return v.Interface().(Unmarshaler), true
+	}
+	return nil, false
+}
+
+// Decode the next value into v.
+func (d *Decoder) value(v reflect.Value) error {
+	if u, ok := unmarshalerOf(v); ok {
+		raw, err := d.readRaw()
+		if err != nil {
+			return err
+		}
+		return u.UnmarshalBencode(raw)
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(v.Elem())
+
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return d.typeError("value", v.Type(), d.offset)
+		}
+
+		val, err := d.any()
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			v.Set(reflect.ValueOf(val))
+		}
+		return nil
+	}
+
+	c, err := d.peekByte()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == 'i':
+		return d.intValue(v)
+	case c >= '0' && c <= '9':
+		return d.stringValue(v)
+	case c == 'l':
+		return d.listValue(v)
+	case c == 'd':
+		return d.dictValue(v)
+	default:
+		return d.errorf("invalid value start %q", c)
+	}
+}
+
+func (d *Decoder) intValue(v reflect.Value) error {
+	start := d.offset
+
+	digits, err := d.readInteger()
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(digits, 10, v.Type().Bits())
+		if err != nil {
+			return &SyntaxError{Offset: start, msg: fmt.Sprintf("integer %s overflows %s", digits, v.Type())}
+		}
+		v.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(digits, 10, v.Type().Bits())
+		if err != nil {
+			return &SyntaxError{Offset: start, msg: fmt.Sprintf("integer %s overflows %s", digits, v.Type())}
+		}
+		v.SetUint(n)
+
+	case reflect.Bool:
+		if digits != "0" && digits != "1" {
+			return d.typeError("integer "+digits, v.Type(), start)
+		}
+		v.SetBool(digits == "1")
+
+	default:
+		return d.typeError("integer", v.Type(), start)
+	}
+	return nil
+}
+
+func (d *Decoder) stringValue(v reflect.Value) error {
+	start := d.offset
+
+	s, err := d.readString()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(s)
+
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(s) != v.Len() {
+			return d.typeError(fmt.Sprintf("string of length %d", len(s)), v.Type(), start)
+		}
+		reflect.Copy(v, reflect.ValueOf(s))
+
+	default:
+		return d.typeError("string", v.Type(), start)
+	}
+	return nil
+}
+
+func (d *Decoder) listValue(v reflect.Value) error {
+	start := d.offset
+
+	switch v.Kind() {
+	case reflect.Slice:
+		v.SetLen(0)
+	case reflect.Array:
+	default:
+		return d.typeError("list", v.Type(), start)
+	}
+
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	d.readByte()
+	for i := 0; ; i++ {
+		if c, err := d.peekByte(); err != nil {
+			return err
+		} else if c == 'e' {
+			d.readByte()
+			break
+		}
+
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		} else if i >= v.Len() {
+			return d.typeError("list longer than array", v.Type(), start)
+		}
+
+		if err := d.value(v.Index(i)); err != nil {
+			return err
+		}
+	}
+
+	// Decoded into a nil slice from an empty list
+	if v.Kind() == reflect.Slice && v.IsNil() {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	return nil
+}
+
+func (d *Decoder) dictValue(v reflect.Value) error {
+	start := d.offset
+
+	var fields *structFields
+	switch {
+	case v.Kind() == reflect.Struct:
+		fields = cachedFields(v.Type())
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	default:
+		return d.typeError("dictionary", v.Type(), start)
+	}
+
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	d.readByte()
+	var keys dictKeys
+	for {
+		if c, err := d.peekByte(); err != nil {
+			return err
+		} else if c == 'e' {
+			d.readByte()
+			return nil
+		}
+
+		offset := d.offset
+		key, err := d.readDictKey()
+		if err != nil {
+			return err
+		}
+
+		if err := d.checkKey(&keys, key, offset); err != nil {
+			return err
+		}
+
+		if fields != nil {
+			f, ok := fields.byKey[string(key)]
+			if !ok {
+				if err := d.skip(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := d.value(v.Field(f.index)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := d.value(elem); err != nil {
+			return err
+		}
+		v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+	}
+}
+
+// Decode the next value into a generic Go value:
+// int64, string, []any or map[string]any.
+func (d *Decoder) any() (any, error) {
+	c, err := d.peekByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c == 'i':
+		var n int64
+		err := d.intValue(reflect.ValueOf(&n).Elem())
+		return n, err
+
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		return string(s), err
+
+	case c == 'l':
+		list := []any{}
+		err := d.listValue(reflect.ValueOf(&list).Elem())
+		return list, err
+
+	case c == 'd':
+		dict := map[string]any{}
+		err := d.dictValue(reflect.ValueOf(&dict).Elem())
+		return dict, err
+
+	default:
+		return nil, d.errorf("invalid value start %q", c)
+	}
+}
@@ -0,0 +1,214 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+var marshalerType = reflect.TypeFor[Marshaler]()
+
+// Marshal returns the canonical bencoding of v.
+//
+// Struct fields are encoded as dictionary keys using the `bencode` tag
+// (`bencode:"key,omitempty"`), in sorted order. Strings, byte slices and
+// byte arrays become strings, integers and bools become integers, slices
+// and arrays become lists, and maps with string keys become dictionaries.
+// Nil pointers and interfaces in structs are left out.
+func Marshal(v any) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := encodeValue(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// An Encoder writes bencoded values to a stream.
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the canonical bencoding of v to the stream.
+func (e *Encoder) Encode(v any) error {
+	data, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(data)
+	return err
+}
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return errors.New("bencode: cannot marshal nil value")
+	}
+
+	if v.Type().Implements(marshalerType) {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			return errors.New("bencode: cannot marshal nil value")
+		}
+		return encodeMarshaler(buf, v.Interface().(Marshaler), v.Type())
+	}
+
+	if v.Kind() != reflect.Pointer && v.CanAddr() && v.Addr().Type().Implements(marshalerType) {
+		return encodeMarshaler(buf, v.Addr().Interface().(Marshaler), v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return errors.New("bencode: cannot marshal nil value")
+		}
+		return encodeValue(buf, v.Elem())
+
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+		buf.WriteByte('e')
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+		buf.WriteByte('e')
+
+	case reflect.String:
+		writeString(buf, v.String())
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			writeString(buf, string(b))
+			return nil
+		}
+
+		buf.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+
+	case reflect.Map:
+		return encodeMap(buf, v)
+
+	case reflect.Struct:
+		return encodeStruct(buf, v)
+
+	default:
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	return nil
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
+
+// Write the output of a Marshaler, making sure it is a canonical value.
+// A VerbatimMessage only has to be valid, its keys may be in any order.
+func encodeMarshaler(buf *bytes.Buffer, m Marshaler, t reflect.Type) error {
+	data, err := m.MarshalBencode()
+	if err != nil {
+		return &MarshalerError{Type: t, Err: err}
+	}
+
+	verbatim := false
+	switch m.(type) {
+	case VerbatimMessage, *VerbatimMessage:
+		verbatim = true
+	}
+	if err := valid(data, verbatim); err != nil {
+		return &MarshalerError{Type: t, Err: err}
+	}
+
+	buf.Write(data)
+	return nil
+}
+
+func encodeMap(buf *bytes.Buffer, v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+
+	buf.WriteByte('d')
+	for _, k := range keys {
+		elem := v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))
+		if isNil(elem) {
+			continue
+		}
+
+		writeString(buf, k)
+		if err := encodeValue(buf, elem); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('e')
+	return nil
+}
+
+func encodeStruct(buf *bytes.Buffer, v reflect.Value) error {
+	buf.WriteByte('d')
+	for _, f := range cachedFields(v.Type()).sorted {
+		fv := v.Field(f.index)
+		if isNil(fv) || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+
+		writeString(buf, f.key)
+		if err := encodeValue(buf, fv); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('e')
+	return nil
+}
+
+// Nil pointers and interfaces have no bencode representation.
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Struct:
+		return v.IsZero()
+	}
+	return false
+}
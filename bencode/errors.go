@@ -0,0 +1,55 @@
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// SyntaxError describes malformed or non-canonical bencode.
+// Offset is the position of the offending byte in the input.
+type SyntaxError struct {
+	Offset int64
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+// UnmarshalTypeError describes a bencode value that can't be stored
+// in a Go value of the given type.
+type UnmarshalTypeError struct {
+	Value  string // "integer", "string", "list" or "dictionary"
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot unmarshal %s into Go value of type %s at offset %d",
+		e.Value, e.Type, e.Offset)
+}
+
+// UnsupportedTypeError is returned when marshalling a Go type
+// that has no bencode representation (e.g. floats, channels).
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "bencode: unsupported type: " + e.Type.String()
+}
+
+// MarshalerError wraps an error returned by a Marshaler,
+// including output that is not valid canonical bencode.
+type MarshalerError struct {
+	Type reflect.Type
+	Err  error
+}
+
+func (e *MarshalerError) Error() string {
+	return fmt.Sprintf("bencode: error calling MarshalBencode for type %s: %v", e.Type, e.Err)
+}
+
+func (e *MarshalerError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,68 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A struct field mapped to a dictionary key.
+type field struct {
+	key       string
+	index     int
+	omitEmpty bool
+}
+
+// The dictionary fields of a struct type, computed once per type.
+type structFields struct {
+	sorted []field           // Sorted by key, the order they are encoded in
+	byKey  map[string]*field // Lookup when decoding
+}
+
+var fieldCache sync.Map // map[reflect.Type]*structFields
+
+// Return the fields of a struct type. Fields are named by their
+// `bencode:"key,omitempty"` tag, or by the field name without a tag.
+// Unexported fields and fields tagged "-" are ignored.
+func cachedFields(t reflect.Type) *structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+
+	sf := &structFields{byKey: map[string]*field{}}
+
+	for i := 0; i < t.NumField(); i++ {
+		sField := t.Field(i)
+		if !sField.IsExported() {
+			continue
+		}
+
+		tag := sField.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		key, opts, _ := strings.Cut(tag, ",")
+		if key == "" {
+			key = sField.Name
+		}
+
+		sf.sorted = append(sf.sorted, field{
+			key:       key,
+			index:     i,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+
+	sort.Slice(sf.sorted, func(i, j int) bool {
+		return sf.sorted[i].key < sf.sorted[j].key
+	})
+
+	for i := range sf.sorted {
+		sf.byKey[sf.sorted[i].key] = &sf.sorted[i]
+	}
+
+	f, _ := fieldCache.LoadOrStore(t, sf)
+	return f.(*structFields)
+}
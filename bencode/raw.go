@@ -0,0 +1,57 @@
+package bencode
+
+import "errors"
+
+// RawMessage is a raw encoded bencode value.
+// Decoding into a RawMessage keeps the exact bytes of the value
+// (e.g. to hash the `info` dictionary of a torrent file), and encoding
+// one writes them out unchanged after checking they are canonical.
+type RawMessage []byte
+
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if m == nil {
+		return nil, errors.New("bencode: cannot marshal nil RawMessage")
+	}
+	return m, nil
+}
+
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	if m == nil {
+		return errors.New("bencode: UnmarshalBencode on nil pointer")
+	}
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+// VerbatimMessage is a RawMessage whose dictionaries may have unsorted keys.
+// Encoding one writes it out unchanged after checking it is a single valid
+// value, for bytes that must be kept exactly, such as an info dictionary
+// already verified against its hash.
+type VerbatimMessage []byte
+
+func (m VerbatimMessage) MarshalBencode() ([]byte, error) {
+	if m == nil {
+		return nil, errors.New("bencode: cannot marshal nil VerbatimMessage")
+	}
+	return m, nil
+}
+
+func (m *VerbatimMessage) UnmarshalBencode(data []byte) error {
+	if m == nil {
+		return errors.New("bencode: UnmarshalBencode on nil pointer")
+	}
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+// Marshaler is implemented by types that encode themselves to bencode.
+// The output MUST be a single canonical bencode value.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that decode themselves from bencode.
+// The input is the raw bytes of a single, already validated value.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
@@ -0,0 +1,151 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// A node listening on loopback that knows no other node.
+func newTestNode(t *testing.T) *Node {
+	t.Helper()
+
+	n, err := NewNode(Config{Addr: "127.0.0.1:0", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func TestPing(t *testing.T) {
+	a, b := newTestNode(t), newTestNode(t)
+
+	if err := a.Ping(b.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both sides learned about each other
+	if a.Len() != 1 || b.Len() != 1 {
+		t.Errorf("routing tables have %d and %d nodes, want 1 each", a.Len(), b.Len())
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	a, b, c := newTestNode(t), newTestNode(t), newTestNode(t)
+
+	// b knows c, a only knows b
+	if err := b.Ping(c.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Bootstrap(b.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[NodeID]bool{}
+	for _, ni := range a.Nodes() {
+		found[ni.ID] = true
+	}
+	if !found[b.ID()] || !found[c.ID()] {
+		t.Errorf("a found %d nodes, want b and c", len(found))
+	}
+}
+
+func TestAnnounceGetPeers(t *testing.T) {
+	a, b, c := newTestNode(t), newTestNode(t), newTestNode(t)
+	infoHash := [20]byte{1, 2, 3}
+
+	if err := a.Bootstrap(b.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Announce(infoHash, 6881); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Bootstrap(b.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := c.GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(addrs) != 1 || !addrs[0].IP.Equal(net.IPv4(127, 0, 0, 1)) || addrs[0].Port != 6881 {
+		t.Errorf("peers = %v, want [127.0.0.1:6881]", addrs)
+	}
+
+	// Nobody announced this one
+	if addrs, _ := c.GetPeers([20]byte{9}); len(addrs) != 0 {
+		t.Errorf("peers of an unknown info hash = %v", addrs)
+	}
+}
+
+func TestAnnounceBadToken(t *testing.T) {
+	a, b := newTestNode(t), newTestNode(t)
+
+	_, err := a.query(b.Addr(), "announce_peer", &args{InfoHash: string(make([]byte, 20)), Port: 6881, Token: "forged"})
+	if err == nil {
+		t.Error("announce_peer with a forged token succeeded")
+	}
+}
+
+func TestStoreEvictsOldestSwarm(t *testing.T) {
+	s := newStore()
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+
+	// Swarms announced one second apart, the first one longest ago
+	start := time.Now()
+	for i := 0; i < maxInfoHashes; i++ {
+		ih := NodeID{byte(i >> 8), byte(i)}
+		s.peers[ih] = map[string]storedPeer{
+			addr.String(): {addr: addr, expires: start.Add(time.Duration(i) * time.Second)},
+		}
+	}
+
+	s.add(NodeID{0xff, 0xff}, addr)
+
+	if len(s.peers) != maxInfoHashes {
+		t.Errorf("store has %d info hashes, want %d", len(s.peers), maxInfoHashes)
+	}
+	if _, ok := s.peers[NodeID{0, 0}]; ok {
+		t.Error("the least recently announced swarm was kept")
+	}
+	if _, ok := s.peers[NodeID{0, 1}]; !ok {
+		t.Error("a more recent swarm was evicted")
+	}
+	if len(s.get(NodeID{0xff, 0xff})) != 1 {
+		t.Error("the new swarm was not stored")
+	}
+}
+
+func TestStoreCapsSwarm(t *testing.T) {
+	s := newStore()
+	ih := NodeID{1}
+
+	// A single host announcing from every port it has
+	start := time.Now()
+	swarm := map[string]storedPeer{}
+	for port := 1; port <= maxPeersPerInfoHash; port++ {
+		addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}
+		swarm[addr.String()] = storedPeer{addr: addr, expires: start.Add(time.Duration(port) * time.Second)}
+	}
+	s.peers[ih] = swarm
+
+	s.add(ih, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 60000})
+
+	if len(s.peers[ih]) != maxPeersPerInfoHash {
+		t.Errorf("swarm has %d peers, want %d", len(s.peers[ih]), maxPeersPerInfoHash)
+	}
+	if _, ok := s.peers[ih]["10.0.0.1:1"]; ok {
+		t.Error("the peer expiring soonest was kept")
+	}
+	if _, ok := s.peers[ih]["10.0.0.1:60000"]; !ok {
+		t.Error("the new peer was not stored")
+	}
+
+	// Announcing again from a stored address replaces it instead
+	s.add(ih, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2})
+	if _, ok := s.peers[ih]["10.0.0.1:3"]; !ok || len(s.peers[ih]) != maxPeersPerInfoHash {
+		t.Error("re-announcing a stored peer evicted another one")
+	}
+}
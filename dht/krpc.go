@@ -0,0 +1,152 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/AcidOP/torrly/bencode"
+)
+
+// KRPC, the DHT's RPC protocol: bencoded dictionaries over UDP.
+// https://www.bittorrent.org/beps/bep_0005.html#krpc-protocol
+
+// KRPC error codes.
+const (
+	errGeneric  = 201
+	errServer   = 202
+	errProtocol = 203
+	errMethod   = 204
+)
+
+type msg struct {
+	T  string `bencode:"t"`            // Transaction ID, echoed in the response
+	Y  string `bencode:"y"`            // "q" for queries, "r" for responses, "e" for errors
+	Q  string `bencode:"q,omitempty"`  // Method name of queries
+	A  *args  `bencode:"a,omitempty"`  // Query arguments
+	R  *reply `bencode:"r,omitempty"`  // Response values
+	E  []any  `bencode:"e,omitempty"`  // Error code and message
+	V  string `bencode:"v,omitempty"`  // Client version
+	IP string `bencode:"ip,omitempty"` // The requester's compact address, in responses (BEP 42)
+}
+
+type args struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`    // find_node
+	InfoHash    string `bencode:"info_hash,omitempty"` // get_peers and announce_peer
+	Port        int    `bencode:"port,omitempty"`      // announce_peer
+	Token       string `bencode:"token,omitempty"`     // announce_peer
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+}
+
+type reply struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`  // Compact node info of the closest nodes
+	Token  string   `bencode:"token,omitempty"`  // get_peers, to be sent back with announce_peer
+	Values []string `bencode:"values,omitempty"` // get_peers, compact peer info
+}
+
+// KRPCError is an error response from a node.
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+func decodeMsg(data []byte) (*msg, error) {
+	// Plenty of nodes don't sort their keys
+	d := bencode.NewDecoder(bytes.NewReader(data))
+	d.AllowUnsortedKeys()
+
+	m := &msg{}
+	if err := d.Decode(m); err != nil {
+		return nil, err
+	}
+	if m.T == "" {
+		return nil, errors.New("missing transaction id")
+	}
+	return m, nil
+}
+
+// The error carried by an error response.
+func (m *msg) err() error {
+	e := &KRPCError{Code: errGeneric}
+	if len(m.E) > 0 {
+		if code, ok := m.E[0].(int64); ok {
+			e.Code = int(code)
+		}
+	}
+	if len(m.E) > 1 {
+		if text, ok := m.E[1].(string); ok {
+			e.Message = text
+		}
+	}
+	return e
+}
+
+// Size of compact node info: 20 bytes ID + 4 bytes IPv4 + 2 bytes port.
+const compactNodeLen = 26
+
+// Encode nodes in compact node info format. IPv6 nodes don't fit and are left out.
+func encodeNodes(nodes []*node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeLen)
+	for _, n := range nodes {
+		ip4 := n.Addr.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		buf = append(buf, n.ID[:]...)
+		buf = append(buf, ip4...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.Addr.Port))
+	}
+	return string(buf)
+}
+
+func decodeNodes(compact string) ([]*node, error) {
+	if len(compact)%compactNodeLen != 0 {
+		return nil, fmt.Errorf("malformed compact nodes: %d bytes", len(compact))
+	}
+
+	nodes := []*node{}
+	for i := 0; i < len(compact); i += compactNodeLen {
+		b := []byte(compact[i : i+compactNodeLen])
+
+		n := &node{Addr: &net.UDPAddr{
+			IP:   net.IP(b[20:24]),
+			Port: int(binary.BigEndian.Uint16(b[24:26])),
+		}}
+		copy(n.ID[:], b[:20])
+
+		if n.Addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// Encode a peer address as compact peer info: 4 or 16 bytes IP + 2 bytes port.
+func encodePeer(addr *net.TCPAddr) string {
+	ip := addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return string(binary.BigEndian.AppendUint16(append([]byte(nil), ip...), uint16(addr.Port)))
+}
+
+func decodePeer(compact string) (*net.TCPAddr, error) {
+	if len(compact) != 6 && len(compact) != 18 {
+		return nil, fmt.Errorf("malformed compact peer: %d bytes", len(compact))
+	}
+
+	b := []byte(compact)
+	return &net.TCPAddr{
+		IP:   net.IP(b[:len(b)-2]),
+		Port: int(binary.BigEndian.Uint16(b[len(b)-2:])),
+	}, nil
+}
@@ -0,0 +1,206 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Number of queries a lookup keeps in flight.
+const alpha = 3
+
+type lookupResult struct {
+	peers   []*net.TCPAddr
+	closest []*node           // Nodes that answered, closest first
+	tokens  map[string]string // get_peers tokens, keyed by node address
+}
+
+// Iterative Kademlia lookup: query the closest nodes we know about `target`
+// for even closer ones until the K closest have all answered or failed.
+// With `getPeers` it asks for peers of the info hash along the way.
+// `seeds` are queried too, e.g. bootstrap nodes whose ID is unknown.
+func (n *Node) lookup(target NodeID, getPeers bool, seeds []*node) *lookupResult {
+	shortlist := append(n.table.closest(target, K), seeds...)
+	known := map[string]bool{}
+	for _, nd := range shortlist {
+		known[nd.Addr.String()] = true
+	}
+
+	self := n.ID()
+	queried := map[string]bool{}
+	failed := map[string]bool{}
+	seenPeers := map[string]bool{}
+	res := &lookupResult{tokens: map[string]string{}}
+
+	type answer struct {
+		nd  *node
+		r   *reply
+		err error
+	}
+
+	for {
+		sortByDistance(shortlist, target)
+
+		// The unqueried nodes among the K closest that haven't failed
+		candidates := []*node{}
+		live := 0
+		for _, nd := range shortlist {
+			if failed[nd.Addr.String()] {
+				continue
+			}
+			if live++; live > K {
+				break
+			}
+			if !queried[nd.Addr.String()] && len(candidates) < alpha {
+				candidates = append(candidates, nd)
+			}
+		}
+		if len(candidates) == 0 {
+			break
+		}
+
+		answers := make(chan answer, len(candidates))
+		for _, nd := range candidates {
+			queried[nd.Addr.String()] = true
+			go func(nd *node) {
+				a := &args{}
+				method := "find_node"
+				if getPeers {
+					method, a.InfoHash = "get_peers", string(target[:])
+				} else {
+					a.Target = string(target[:])
+				}
+
+				r, err := n.query(nd.Addr, method, a)
+				answers <- answer{nd, r, err}
+			}(nd)
+		}
+
+		for range candidates {
+			a := <-answers
+			if a.err != nil {
+				failed[a.nd.Addr.String()] = true
+				continue
+			}
+
+			// Seeds only get their real ID once they answer
+			copy(a.nd.ID[:], a.r.ID)
+			res.closest = append(res.closest, a.nd)
+			if a.r.Token != "" {
+				res.tokens[a.nd.Addr.String()] = a.r.Token
+			}
+
+			for _, v := range a.r.Values {
+				p, err := decodePeer(v)
+				if err != nil || seenPeers[p.String()] {
+					continue
+				}
+				seenPeers[p.String()] = true
+				res.peers = append(res.peers, p)
+			}
+
+			nodes, err := decodeNodes(a.r.Nodes)
+			if err != nil {
+				continue
+			}
+			for _, nd := range nodes {
+				if nd.ID == self || known[nd.Addr.String()] {
+					continue
+				}
+				known[nd.Addr.String()] = true
+				shortlist = append(shortlist, nd)
+			}
+		}
+	}
+
+	sortByDistance(res.closest, target)
+	res.closest = res.closest[:min(K, len(res.closest))]
+	return res
+}
+
+// Look up the nodes closest to `target`, filling the routing table.
+func (n *Node) findNodes(target NodeID) *lookupResult {
+	return n.lookup(target, false, n.seeds())
+}
+
+// The configured bootstrap nodes, if the routing table is empty.
+func (n *Node) seeds() []*node {
+	if n.table.len() > 0 {
+		return nil
+	}
+	return resolveNodes(n.cfg.BootstrapNodes)
+}
+
+func resolveNodes(hostports []string) []*node {
+	nodes := []*node{}
+	for _, hp := range hostports {
+		addr, err := net.ResolveUDPAddr("udp", hp)
+		if err != nil {
+			fmt.Printf("Failed to resolve DHT node %q: %v\n", hp, err)
+			continue
+		}
+		nodes = append(nodes, &node{Addr: addr})
+	}
+	return nodes
+}
+
+// Bootstrap joins the DHT by looking up our own ID through the nodes of
+// the restored routing table and `extra` nodes (e.g. from a torrent's
+// `nodes` key). The configured bootstrap nodes are only used if no
+// restored node answered.
+func (n *Node) Bootstrap(extra ...string) error {
+	n.waitRestored()
+
+	seeds := resolveNodes(extra)
+	if n.table.len() == 0 {
+		seeds = append(resolveNodes(n.cfg.BootstrapNodes), seeds...)
+	}
+	n.lookup(n.ID(), false, seeds)
+
+	if n.table.len() == 0 {
+		return errors.New("no DHT node answered")
+	}
+	return nil
+}
+
+// GetPeers looks up the peers of an info hash.
+func (n *Node) GetPeers(infoHash [20]byte) ([]*net.TCPAddr, error) {
+	res := n.lookup(NodeID(infoHash), true, n.seeds())
+	if len(res.closest) == 0 {
+		return nil, errors.New("no DHT node answered")
+	}
+	return res.peers, nil
+}
+
+// Announce looks up the peers of an info hash and tells the closest nodes
+// that we are in its swarm, listening on TCP `port`. A zero port asks them
+// to use the source port of our packets instead.
+func (n *Node) Announce(infoHash [20]byte, port int) ([]*net.TCPAddr, error) {
+	res := n.lookup(NodeID(infoHash), true, n.seeds())
+	if len(res.closest) == 0 {
+		return nil, errors.New("no DHT node answered")
+	}
+
+	var wg sync.WaitGroup
+	for _, nd := range res.closest {
+		token, ok := res.tokens[nd.Addr.String()]
+		if !ok {
+			continue
+		}
+
+		a := &args{InfoHash: string(infoHash[:]), Port: port, Token: token}
+		if port == 0 {
+			a.ImpliedPort = 1
+		}
+
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			n.query(addr, "announce_peer", a)
+		}(nd.Addr)
+	}
+	wg.Wait()
+
+	return res.peers, nil
+}
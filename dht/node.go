@@ -0,0 +1,400 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AcidOP/torrly/bencode"
+)
+
+const (
+	defaultTimeout   = 5 * time.Second
+	maintenanceEvery = time.Minute
+	refreshEvery     = 15 * time.Minute
+	clientVersion    = "TY01"
+	maxPacketSize    = 4096
+)
+
+// Well known nodes to join the DHT through.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+type Config struct {
+	Addr           string        // UDP address to listen on, e.g. ":6881"
+	ID             NodeID        // Our node ID, zero picks a random one
+	BootstrapNodes []string      // Nodes to join the DHT through, as host:port
+	Timeout        time.Duration // How long to wait for a response, 0 uses 5 seconds
+	StateFile      string        // File the routing table is saved to and restored from, empty to not keep it
+	OnExternalIP   func(net.IP)  // Called when other nodes agree on a new external address for us
+}
+
+// Node is a mainline DHT node (BEP 5). It answers queries from other
+// nodes and finds and announces peers for info hashes.
+// https://www.bittorrent.org/beps/bep_0005.html
+type Node struct {
+	cfg    Config
+	id     NodeID
+	conn   *net.UDPConn
+	table  *table
+	tokens *tokens
+	store  *store
+
+	mu         sync.Mutex
+	pending    map[string]chan *msg // Outstanding queries, keyed by address and transaction ID
+	nextTx     uint16
+	ipVotes    map[string]map[string]bool // Nodes reporting each external address
+	externalIP net.IP
+
+	restored chan struct{} // Closed once the saved routing table is restored
+	closed   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewNode starts a DHT node listening on cfg.Addr, restoring the routing
+// table saved in cfg.StateFile. Call Bootstrap to join the network.
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.ID == (NodeID{}) && cfg.StateFile != "" {
+		cfg.ID, _ = loadID(cfg.StateFile)
+	}
+	if cfg.ID == (NodeID{}) {
+		cfg.ID = RandomNodeID()
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		cfg:      cfg,
+		id:       cfg.ID,
+		conn:     conn,
+		table:    newTable(cfg.ID),
+		tokens:   newTokens(),
+		store:    newStore(),
+		pending:  map[string]chan *msg{},
+		restored: make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	n.wg.Add(3)
+	go n.readLoop()
+	go n.maintain()
+	go n.restore()
+	return n, nil
+}
+
+// ID returns our node ID. It changes once the external address
+// is known if it isn't valid for it (BEP 42).
+func (n *Node) ID() NodeID {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.id
+}
+
+// Addr returns the UDP address the node listens on.
+func (n *Node) Addr() *net.UDPAddr {
+	return n.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Number of nodes in the routing table.
+func (n *Node) Len() int {
+	return n.table.len()
+}
+
+// Close saves the routing table and stops the node.
+func (n *Node) Close() error {
+	select {
+	case <-n.closed:
+		return nil
+	default:
+	}
+
+	if err := n.Save(); err != nil {
+		fmt.Println("Failed to save the DHT routing table:", err)
+	}
+
+	close(n.closed)
+	err := n.conn.Close()
+	n.wg.Wait()
+	return err
+}
+
+func (n *Node) readLoop() {
+	defer n.wg.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		size, addr, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-n.closed:
+				return
+			default:
+			}
+
+			if isTemporary(err) {
+				continue
+			}
+			fmt.Println("DHT node stopped listening:", err)
+			return
+		}
+
+		m, err := decodeMsg(buf[:size])
+		if err != nil {
+			continue
+		}
+
+		switch m.Y {
+		case "q":
+			n.handleQuery(addr, m)
+		case "r", "e":
+			n.handleResponse(addr, m)
+		}
+	}
+}
+
+func isTemporary(err error) bool {
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
+}
+
+// Periodically rotate tokens, forget stale peers, keep the table fresh and save it.
+func (n *Node) maintain() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(maintenanceEvery)
+	defer ticker.Stop()
+
+	lastRefresh, lastSave := time.Now(), time.Now()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-ticker.C:
+		}
+
+		n.tokens.rotate()
+		n.store.expire()
+
+		if time.Since(lastRefresh) >= refreshEvery {
+			lastRefresh = time.Now()
+			n.refresh()
+		}
+
+		if time.Since(lastSave) >= saveEvery {
+			lastSave = time.Now()
+			if err := n.Save(); err != nil {
+				fmt.Println("Failed to save the DHT routing table:", err)
+			}
+		}
+	}
+}
+
+// Ping the questionable nodes and look up our own ID to find new ones.
+func (n *Node) refresh() {
+	for _, nd := range n.table.all() {
+		if !nd.good() {
+			go n.Ping(nd.Addr)
+		}
+	}
+	n.findNodes(n.ID())
+}
+
+func (n *Node) handleQuery(addr *net.UDPAddr, m *msg) {
+	if m.A == nil || len(m.A.ID) != 20 {
+		n.sendError(addr, m.T, errProtocol, "missing id")
+		return
+	}
+
+	var id NodeID
+	copy(id[:], m.A.ID)
+	n.table.insert(id, addr)
+
+	self := n.ID()
+	r := &reply{ID: string(self[:])}
+
+	switch m.Q {
+	case "ping":
+
+	case "find_node":
+		target, ok := toID(m.A.Target)
+		if !ok {
+			n.sendError(addr, m.T, errProtocol, "invalid target")
+			return
+		}
+		r.Nodes = encodeNodes(n.table.closest(target, K))
+
+	case "get_peers":
+		infoHash, ok := toID(m.A.InfoHash)
+		if !ok {
+			n.sendError(addr, m.T, errProtocol, "invalid info_hash")
+			return
+		}
+
+		r.Token = n.tokens.issue(addr.IP)
+		if peers := n.store.get(infoHash); len(peers) > 0 {
+			for _, p := range peers {
+				r.Values = append(r.Values, encodePeer(p))
+			}
+		} else {
+			r.Nodes = encodeNodes(n.table.closest(infoHash, K))
+		}
+
+	case "announce_peer":
+		infoHash, ok := toID(m.A.InfoHash)
+		if !ok {
+			n.sendError(addr, m.T, errProtocol, "invalid info_hash")
+			return
+		}
+		if !n.tokens.valid(m.A.Token, addr.IP) {
+			n.sendError(addr, m.T, errProtocol, "bad token")
+			return
+		}
+
+		port := m.A.Port
+		if m.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			n.sendError(addr, m.T, errProtocol, "invalid port")
+			return
+		}
+		n.store.add(infoHash, &net.TCPAddr{IP: addr.IP, Port: port})
+
+	default:
+		n.sendError(addr, m.T, errMethod, "method unknown")
+		return
+	}
+
+	n.send(addr, &msg{T: m.T, Y: "r", R: r, IP: compactAddr(addr)})
+}
+
+func (n *Node) handleResponse(addr *net.UDPAddr, m *msg) {
+	n.mu.Lock()
+	ch, ok := n.pending[addr.String()+"/"+m.T]
+	delete(n.pending, addr.String()+"/"+m.T)
+	n.mu.Unlock()
+
+	if ok {
+		ch <- m
+	}
+}
+
+func (n *Node) send(addr *net.UDPAddr, m *msg) error {
+	m.V = clientVersion
+
+	data, err := bencode.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = n.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (n *Node) sendError(addr *net.UDPAddr, tx string, code int, text string) {
+	n.send(addr, &msg{T: tx, Y: "e", E: []any{code, text}})
+}
+
+// Send a query and wait for the response.
+// Nodes that answer are added to the routing table.
+func (n *Node) query(addr *net.UDPAddr, method string, a *args) (*reply, error) {
+	self := n.ID()
+	a.ID = string(self[:])
+
+	n.mu.Lock()
+	n.nextTx++
+	tx := string(binary.BigEndian.AppendUint16(nil, n.nextTx))
+	key := addr.String() + "/" + tx
+	ch := make(chan *msg, 1)
+	n.pending[key] = ch
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, key)
+		n.mu.Unlock()
+	}()
+
+	if err := n.send(addr, &msg{T: tx, Y: "q", Q: method, A: a}); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(n.cfg.Timeout)
+	defer timer.Stop()
+
+	select {
+	case m := <-ch:
+		if m.Y == "e" {
+			return nil, m.err()
+		}
+
+		id, ok := toID(m.R.idOrEmpty())
+		if !ok {
+			return nil, fmt.Errorf("node %s: response without id", addr)
+		}
+		n.table.insert(id, addr)
+
+		if m.IP != "" {
+			n.voteExternalIP(m.IP, addr)
+		}
+		return m.R, nil
+
+	case <-timer.C:
+		n.table.failed(addr)
+		return nil, fmt.Errorf("node %s: no response", addr)
+
+	case <-n.closed:
+		return nil, errors.New("dht node closed")
+	}
+}
+
+// Ping checks whether a node is alive and adds it to the routing table.
+func (n *Node) Ping(addr *net.UDPAddr) error {
+	_, err := n.query(addr, "ping", &args{})
+	return err
+}
+
+// AddNode pings a node, e.g. one learned from a peer's PORT message or
+// from the `nodes` of a torrent file, and adds it to the routing table
+// if it answers.
+func (n *Node) AddNode(hostport string) {
+	go func() {
+		addr, err := net.ResolveUDPAddr("udp", hostport)
+		if err != nil {
+			return
+		}
+		n.Ping(addr)
+	}()
+}
+
+func (r *reply) idOrEmpty() string {
+	if r == nil {
+		return ""
+	}
+	return r.ID
+}
+
+func toID(s string) (NodeID, bool) {
+	var id NodeID
+	if len(s) != len(id) {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
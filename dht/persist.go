@@ -0,0 +1,290 @@
+package dht
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AcidOP/torrly/bencode"
+)
+
+const (
+	saveEvery = 10 * time.Minute
+
+	// Saved nodes pinged at once when restoring the routing table
+	restoreConcurrency = 8
+)
+
+// NodeInfo is a node of a saved routing table or of an exported node list.
+type NodeInfo struct {
+	ID       NodeID    // Zero if unknown, the node tells us when pinged
+	Addr     string    // host:port
+	LastSeen time.Time // Zero if never heard from
+}
+
+// On-disk form of a routing table or node list.
+type savedState struct {
+	ID    string      `bencode:"id,omitempty"` // Our node ID, only in routing tables
+	Nodes []savedNode `bencode:"nodes"`
+}
+
+type savedNode struct {
+	ID       string `bencode:"id,omitempty"`
+	Addr     string `bencode:"addr"`
+	LastSeen int64  `bencode:"seen,omitempty"` // Unix time
+}
+
+// Nodes returns the nodes of the routing table, good ones first and
+// the rest most recently seen first.
+func (n *Node) Nodes() []NodeInfo {
+	all := n.table.all()
+	slices.SortStableFunc(all, func(a, b *node) int {
+		if a.good() != b.good() {
+			if a.good() {
+				return -1
+			}
+			return 1
+		}
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+
+	nodes := []NodeInfo{}
+	for _, nd := range all {
+		nodes = append(nodes, NodeInfo{ID: nd.ID, Addr: nd.Addr.String(), LastSeen: nd.LastSeen})
+	}
+	return nodes
+}
+
+// ImportNodes pings the given nodes in order, adding those that answer
+// to the routing table.
+func (n *Node) ImportNodes(nodes []NodeInfo) {
+	go n.pingNodes(nodes, func() {})
+}
+
+// Ping `nodes` in order, a few at a time. `enough` is called once
+// K nodes answered or all of them were tried, whichever comes first.
+func (n *Node) pingNodes(nodes []NodeInfo, enough func()) {
+	var once sync.Once
+	defer once.Do(enough)
+
+	var (
+		mu       sync.Mutex
+		answered int
+		wg       sync.WaitGroup
+	)
+	defer wg.Wait()
+	sem := make(chan struct{}, restoreConcurrency)
+
+	for _, ni := range nodes {
+		select {
+		case sem <- struct{}{}:
+		case <-n.closed:
+			return
+		}
+
+		wg.Add(1)
+		go func(hostport string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			addr, err := net.ResolveUDPAddr("udp", hostport)
+			if err != nil || n.Ping(addr) != nil {
+				return
+			}
+
+			mu.Lock()
+			if answered++; answered >= K {
+				once.Do(enough)
+			}
+			mu.Unlock()
+		}(ni.Addr)
+	}
+}
+
+// Load the routing table saved in cfg.StateFile: adopt its node ID unless
+// one was configured and ping its nodes, good ones first.
+func (n *Node) restore() {
+	defer n.wg.Done()
+
+	// Restored once enough nodes answered, or right away without a saved table
+	restored := sync.OnceFunc(func() { close(n.restored) })
+	defer restored()
+
+	if n.cfg.StateFile == "" {
+		return
+	}
+
+	f, err := os.Open(n.cfg.StateFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	state, err := readState(f)
+	if err != nil {
+		return
+	}
+
+	// Returns early once the node is closed
+	n.pingNodes(state.nodes(), restored)
+}
+
+// Wait for the saved routing table to be restored.
+func (n *Node) waitRestored() {
+	select {
+	case <-n.restored:
+	case <-n.closed:
+	}
+}
+
+// Save writes the routing table and our node ID to cfg.StateFile,
+// so a restarted node can rejoin the DHT without the bootstrap nodes.
+func (n *Node) Save() error {
+	if n.cfg.StateFile == "" {
+		return nil
+	}
+
+	// Don't overwrite a saved table with the empty one of a node that hasn't started up yet
+	select {
+	case <-n.restored:
+	default:
+		return nil
+	}
+
+	state := newSavedState(n.Nodes())
+	id := n.ID()
+	state.ID = string(id[:])
+	return writeStateFile(n.cfg.StateFile, state)
+}
+
+// Read our node ID from a saved routing table, if there is one.
+func loadID(path string) (NodeID, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return NodeID{}, false
+	}
+	defer f.Close()
+
+	state, err := readState(f)
+	if err != nil {
+		return NodeID{}, false
+	}
+	return toID(state.ID)
+}
+
+// ReadNodes reads a node list written by WriteNodes, or the nodes of
+// a saved routing table.
+func ReadNodes(r io.Reader) ([]NodeInfo, error) {
+	state, err := readState(r)
+	if err != nil {
+		return nil, err
+	}
+	return state.nodes(), nil
+}
+
+// WriteNodes writes a node list to be read with ReadNodes, e.g. to seed
+// the routing table of a node that cannot reach the bootstrap nodes.
+func WriteNodes(w io.Writer, nodes []NodeInfo) error {
+	data, err := bencode.Marshal(newSavedState(nodes))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// MergeNodes adds nodes to the routing table saved at `path`, creating it
+// if needed. They are pinged the next time a node starts from that file.
+func MergeNodes(path string, nodes []NodeInfo) error {
+	state := &savedState{}
+	if f, err := os.Open(path); err == nil {
+		state, err = readState(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	known := map[string]bool{}
+	for _, sn := range state.Nodes {
+		known[sn.Addr] = true
+	}
+
+	for _, sn := range newSavedState(nodes).Nodes {
+		if !known[sn.Addr] {
+			known[sn.Addr] = true
+			state.Nodes = append(state.Nodes, sn)
+		}
+	}
+	return writeStateFile(path, state)
+}
+
+func newSavedState(nodes []NodeInfo) *savedState {
+	state := &savedState{Nodes: []savedNode{}}
+	for _, ni := range nodes {
+		sn := savedNode{Addr: ni.Addr}
+		if ni.ID != (NodeID{}) {
+			sn.ID = string(ni.ID[:])
+		}
+		if !ni.LastSeen.IsZero() {
+			sn.LastSeen = ni.LastSeen.Unix()
+		}
+		state.Nodes = append(state.Nodes, sn)
+	}
+	return state
+}
+
+func (s *savedState) nodes() []NodeInfo {
+	nodes := []NodeInfo{}
+	for _, sn := range s.Nodes {
+		if _, _, err := net.SplitHostPort(sn.Addr); err != nil {
+			continue
+		}
+
+		ni := NodeInfo{Addr: sn.Addr}
+		ni.ID, _ = toID(sn.ID)
+		if sn.LastSeen != 0 {
+			ni.LastSeen = time.Unix(sn.LastSeen, 0)
+		}
+		nodes = append(nodes, ni)
+	}
+	return nodes
+}
+
+func readState(r io.Reader) (*savedState, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &savedState{}
+	if err := bencode.Unmarshal(data, state); err != nil {
+		return nil, errors.New("invalid DHT node file: " + err.Error())
+	}
+	return state, nil
+}
+
+// Write through a temporary file, so a crash never leaves a truncated table behind.
+func writeStateFile(path string, state *savedState) error {
+	data, err := bencode.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,140 @@
+package dht
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+)
+
+// DHT security extension: node IDs are tied to the node's external IP, so
+// nobody can pick IDs next to a target at will to take over its lookups.
+// https://www.bittorrent.org/beps/bep_0042.html
+
+// Number of nodes that must report the same external address before we believe it.
+const externalIPVotes = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// The crc32c of the masked IP whose top 21 bits a node ID at `ip` must
+// start with, given the random number r (0-7) in the ID's last byte.
+func idPrefix(ip net.IP, r byte) (uint32, bool) {
+	var masked []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		masked = []byte{0x03, 0x0f, 0x3f, 0xff}
+		for i := range masked {
+			masked[i] &= ip4[i]
+		}
+	} else if ip16 := ip.To16(); ip16 != nil {
+		masked = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+		for i := range masked {
+			masked[i] &= ip16[i]
+		}
+	} else {
+		return 0, false
+	}
+
+	masked[0] |= (r & 0x07) << 5
+	return crc32.Checksum(masked, castagnoli), true
+}
+
+// SecureNodeID returns a random node ID that is valid for a node
+// whose external address is `ip`.
+func SecureNodeID(ip net.IP) NodeID {
+	id := RandomNodeID()
+
+	crc, ok := idPrefix(ip, id[19]&0x07)
+	if !ok {
+		return id
+	}
+
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+	return id
+}
+
+// Whether `id` is valid for a node at `ip`.
+// Nodes on local networks may use any ID.
+func secureID(id NodeID, ip net.IP) bool {
+	if exemptIP(ip) {
+		return true
+	}
+
+	crc, ok := idPrefix(ip, id[19]&0x07)
+	if !ok {
+		return false
+	}
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+func exemptIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// The `ip` of a response: the requester's address as we see it.
+func compactAddr(addr *net.UDPAddr) string {
+	return encodePeer(&net.TCPAddr{IP: addr.IP, Port: addr.Port})
+}
+
+// Count the external address a responding node saw us at. Once enough
+// nodes agree, adopt it and move to a node ID that is valid for it.
+func (n *Node) voteExternalIP(compact string, voter *net.UDPAddr) {
+	addr, err := decodePeer(compact)
+	if err != nil {
+		return
+	}
+	ip := addr.IP
+
+	n.mu.Lock()
+
+	// Forget the votes for addresses nobody else reports
+	if len(n.ipVotes) > 16 {
+		n.ipVotes = nil
+	}
+	if n.ipVotes == nil {
+		n.ipVotes = map[string]map[string]bool{}
+	}
+
+	voters := n.ipVotes[ip.String()]
+	if voters == nil {
+		voters = map[string]bool{}
+		n.ipVotes[ip.String()] = voters
+	}
+	voters[voter.IP.String()] = true
+
+	if len(voters) < externalIPVotes {
+		n.mu.Unlock()
+		return
+	}
+	n.ipVotes = nil
+
+	changed := !ip.Equal(n.externalIP)
+	n.externalIP = ip
+
+	rekey := !secureID(n.id, ip)
+	if rekey {
+		n.id = SecureNodeID(ip)
+	}
+	id := n.id
+	n.mu.Unlock()
+
+	if changed {
+		fmt.Println("DHT nodes report our external address as", ip)
+		if n.cfg.OnExternalIP != nil {
+			n.cfg.OnExternalIP(ip)
+		}
+	}
+
+	if rekey {
+		fmt.Printf("Changing DHT node ID to %x to match our external address\n", id)
+		n.table.rekey(id)
+	}
+}
+
+// ExternalIP returns our external address as reported by other nodes,
+// nil until enough of them agree.
+func (n *Node) ExternalIP() net.IP {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.externalIP
+}
@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	peerTTL       = 30 * time.Minute // Announced peers are forgotten after this long
+	maxPeerValues = 50               // Peers returned by a single get_peers
+	maxInfoHashes = 2000             // Swarms we keep peers for, the least recently announced go first
+
+	// Peers kept per swarm, the ones expiring soonest go first. Addresses
+	// include the port, so a single host could otherwise fill a swarm.
+	maxPeersPerInfoHash = 500
+)
+
+// store keeps the peers announced to us, per info hash.
+type store struct {
+	mu    sync.Mutex
+	peers map[NodeID]map[string]storedPeer // Keyed by info hash, then address
+}
+
+type storedPeer struct {
+	addr    *net.TCPAddr
+	expires time.Time
+}
+
+func newStore() *store {
+	return &store{peers: map[NodeID]map[string]storedPeer{}}
+}
+
+func (s *store) add(infoHash NodeID, addr *net.TCPAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.peers[infoHash] == nil {
+		if len(s.peers) >= maxInfoHashes {
+			s.evict()
+		}
+		s.peers[infoHash] = map[string]storedPeer{}
+	}
+
+	swarm := s.peers[infoHash]
+	if _, ok := swarm[addr.String()]; !ok && len(swarm) >= maxPeersPerInfoHash {
+		evictPeer(swarm)
+	}
+	swarm[addr.String()] = storedPeer{addr: addr, expires: time.Now().Add(peerTTL)}
+}
+
+// Up to maxPeerValues peers of the info hash.
+func (s *store) get(infoHash NodeID) []*net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := []*net.TCPAddr{}
+	for _, p := range s.peers[infoHash] {
+		if len(addrs) == maxPeerValues {
+			break
+		}
+		if time.Now().Before(p.expires) {
+			addrs = append(addrs, p.addr)
+		}
+	}
+	return addrs
+}
+
+// Make room for another info hash by dropping the swarm that was
+// announced to least recently. Caller must hold s.mu.
+func (s *store) evict() {
+	var (
+		oldest       NodeID
+		oldestExpiry time.Time
+		found        bool
+	)
+
+	for ih, swarm := range s.peers {
+		latest := time.Time{}
+		for _, p := range swarm {
+			if p.expires.After(latest) {
+				latest = p.expires
+			}
+		}
+		if !found || latest.Before(oldestExpiry) {
+			oldest, oldestExpiry, found = ih, latest, true
+		}
+	}
+
+	if found {
+		delete(s.peers, oldest)
+	}
+}
+
+// Make room in a swarm by dropping the peer that expires soonest.
+func evictPeer(swarm map[string]storedPeer) {
+	var (
+		soonest string
+		expiry  time.Time
+	)
+
+	for key, p := range swarm {
+		if soonest == "" || p.expires.Before(expiry) {
+			soonest, expiry = key, p.expires
+		}
+	}
+	delete(swarm, soonest)
+}
+
+// Drop the peers that weren't announced again in time.
+func (s *store) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ih, swarm := range s.peers {
+		for addr, p := range swarm {
+			if time.Now().After(p.expires) {
+				delete(swarm, addr)
+			}
+		}
+		if len(swarm) == 0 {
+			delete(s.peers, ih)
+		}
+	}
+}
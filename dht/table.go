@@ -0,0 +1,216 @@
+package dht
+
+import (
+	"crypto/rand"
+	"math/bits"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	K        = 8 // Nodes per bucket, and the number of closest nodes a lookup looks for
+	idBits   = 160
+	maxFails = 2 // Unanswered queries before a node is considered bad
+
+	// Nodes not heard from for this long are questionable
+	questionableAfter = 15 * time.Minute
+)
+
+// NodeID identifies a node in the DHT, and lives in the same space as info hashes.
+type NodeID [20]byte
+
+func RandomNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+// Distance between two IDs: their XOR, compared as a big-endian number.
+func (id NodeID) xor(other NodeID) NodeID {
+	var d NodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// Number of leading bits two IDs have in common.
+func (id NodeID) commonPrefix(other NodeID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return idBits
+}
+
+type node struct {
+	ID       NodeID
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+	Fails    int  // Queries left unanswered in a row
+	Secure   bool // Whether the ID is valid for the node's address (BEP 42)
+}
+
+func (n *node) good() bool {
+	return n.Fails == 0 && time.Since(n.LastSeen) < questionableAfter
+}
+
+// table is a Kademlia routing table. Bucket i holds the nodes sharing exactly
+// i leading bits with our own ID, so buckets close to us cover fewer IDs.
+type table struct {
+	self NodeID
+
+	mu      sync.Mutex
+	buckets [idBits][]*node
+}
+
+func newTable(self NodeID) *table {
+	return &table{self: self}
+}
+
+func (t *table) bucket(id NodeID) int {
+	return min(t.self.commonPrefix(id), idBits-1)
+}
+
+// Add a node we heard from, or refresh it if we already know it.
+// A full bucket only makes room by evicting a bad node, or for a node
+// with a secure ID, the longest known node without one.
+func (t *table) insert(id NodeID, addr *net.UDPAddr) {
+	if addr.Port == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.add(&node{ID: id, Addr: addr, LastSeen: time.Now(), Secure: secureID(id, addr.IP)})
+}
+
+// Callers MUST hold t.mu.
+func (t *table) add(n *node) {
+	if n.ID == t.self {
+		return
+	}
+
+	b := &t.buckets[t.bucket(n.ID)]
+	for i, old := range *b {
+		if old.ID == n.ID {
+			// Most recently seen nodes go to the back
+			*b = append(append((*b)[:i], (*b)[i+1:]...), n)
+			return
+		}
+	}
+
+	if len(*b) < K {
+		*b = append(*b, n)
+		return
+	}
+
+	for i, old := range *b {
+		if old.Fails >= maxFails {
+			*b = append(append((*b)[:i], (*b)[i+1:]...), n)
+			return
+		}
+	}
+
+	if !n.Secure {
+		return
+	}
+	for i, old := range *b {
+		if !old.Secure {
+			*b = append(append((*b)[:i], (*b)[i+1:]...), n)
+			return
+		}
+	}
+}
+
+// Move the table to a new node ID of ours, sorting the nodes into the
+// buckets of the new ID. Nodes that no longer fit are dropped.
+func (t *table) rekey(self NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	old := t.buckets
+	t.self = self
+	t.buckets = [idBits][]*node{}
+
+	for _, b := range old {
+		for _, n := range b {
+			t.add(n)
+		}
+	}
+}
+
+// Record a query the node at `addr` didn't answer.
+func (t *table) failed(addr *net.UDPAddr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, b := range t.buckets {
+		for _, n := range b {
+			if n.Addr.IP.Equal(addr.IP) && n.Addr.Port == addr.Port {
+				n.Fails++
+			}
+		}
+	}
+}
+
+// The `count` nodes closest to `target`, closest first. Bad nodes are left
+// out, and nodes without a secure ID only make up for missing secure ones.
+func (t *table) closest(target NodeID, count int) []*node {
+	secure, insecure := []*node{}, []*node{}
+	for _, n := range t.all() {
+		if n.Fails >= maxFails {
+			continue
+		}
+		if n.Secure {
+			secure = append(secure, n)
+		} else {
+			insecure = append(insecure, n)
+		}
+	}
+
+	sortByDistance(secure, target)
+	sortByDistance(insecure, target)
+
+	closest := append(secure[:min(count, len(secure))], insecure...)
+	closest = closest[:min(count, len(closest))]
+	sortByDistance(closest, target)
+	return closest
+}
+
+// Copies of every node in the table.
+func (t *table) all() []*node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	all := []*node{}
+	for _, b := range t.buckets {
+		for _, n := range b {
+			c := *n
+			all = append(all, &c)
+		}
+	}
+	return all
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	count := 0
+	for _, b := range t.buckets {
+		count += len(b)
+	}
+	return count
+}
+
+func sortByDistance(nodes []*node, target NodeID) {
+	slices.SortFunc(nodes, func(a, b *node) int {
+		da, db := a.ID.xor(target), b.ID.xor(target)
+		return slices.Compare(da[:], db[:])
+	})
+}
@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// Tokens handed out by get_peers are valid for one to two rotations.
+const tokenRotation = 5 * time.Minute
+
+// tokens issues and checks the write tokens of announce_peer.
+// A token is a hash of the querying node's IP and a secret that changes
+// every few minutes. Tokens made with the previous secret are still accepted.
+type tokens struct {
+	mu       sync.Mutex
+	secret   [20]byte
+	previous [20]byte
+	rotated  time.Time
+}
+
+func newTokens() *tokens {
+	tk := &tokens{rotated: time.Now()}
+	rand.Read(tk.secret[:])
+	tk.previous = tk.secret
+	return tk
+}
+
+// Rotate the secret if it is old enough.
+func (tk *tokens) rotate() {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	if time.Since(tk.rotated) < tokenRotation {
+		return
+	}
+	tk.previous = tk.secret
+	rand.Read(tk.secret[:])
+	tk.rotated = time.Now()
+}
+
+func (tk *tokens) issue(ip net.IP) string {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	return makeToken(tk.secret, ip)
+}
+
+func (tk *tokens) valid(token string, ip net.IP) bool {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	return token == makeToken(tk.secret, ip) || token == makeToken(tk.previous, ip)
+}
+
+func makeToken(secret [20]byte, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h := sha1.Sum(append(secret[:], ip...))
+	return string(h[:8])
+}
@@ -1,5 +1,3 @@
 module github.com/AcidOP/torrly
 
 go 1.24.4
-
-require github.com/jackpal/bencode-go v1.0.2 
@@ -0,0 +1,232 @@
+package lsd
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local service discovery: peers announce the torrents they have to a
+// multicast group, so peers on the same network find each other without
+// a tracker.
+// https://www.bittorrent.org/beps/bep_0014.html
+const (
+	AnnounceInterval    = 5 * time.Minute // How often to announce a torrent
+	MinAnnounceInterval = time.Minute     // Never announce a torrent more often than this
+
+	// Keep announces within a single unfragmented packet
+	maxPacketSize = 1400
+	maxHashes     = 20
+)
+
+var (
+	groupV4 = &net.UDPAddr{IP: net.ParseIP("239.192.152.143"), Port: 6771}
+	groupV6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+// Service sends and receives LSD announces. Announces for info hashes
+// nobody subscribed to are ignored.
+type Service struct {
+	port   int
+	cookie string // Tells our own announces apart when they loop back
+	conns  []*net.UDPConn
+	groups []*net.UDPAddr // Group of each connection
+
+	mu   sync.Mutex
+	subs map[[20]byte]func(*net.TCPAddr)
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Listen joins the IPv4 and IPv6 LSD groups and announces TCP `port` as
+// ours. It only fails if neither group can be joined.
+func Listen(port int) (*Service, error) {
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	s := &Service{
+		port:   port,
+		cookie: hex.EncodeToString(cookie),
+		subs:   map[[20]byte]func(*net.TCPAddr){},
+		closed: make(chan struct{}),
+	}
+
+	errs := []error{}
+	for _, group := range []*net.UDPAddr{groupV4, groupV6} {
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+
+		conn, err := net.ListenMulticastUDP(network, nil, group)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", group, err))
+			continue
+		}
+		s.conns = append(s.conns, conn)
+		s.groups = append(s.groups, group)
+	}
+
+	if len(s.conns) == 0 {
+		return nil, fmt.Errorf("cannot join any LSD group: %v", errors.Join(errs...))
+	}
+
+	for _, conn := range s.conns {
+		s.wg.Add(1)
+		go s.readLoop(conn)
+	}
+	return s, nil
+}
+
+// Subscribe calls onPeer with every local peer announcing `infoHash`.
+func (s *Service) Subscribe(infoHash [20]byte, onPeer func(*net.TCPAddr)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[infoHash] = onPeer
+}
+
+func (s *Service) Unsubscribe(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, infoHash)
+}
+
+// Announce tells the local network we are in the swarms of `infoHashes`.
+// Callers are responsible for not announcing a torrent more than once
+// per MinAnnounceInterval.
+func (s *Service) Announce(infoHashes ...[20]byte) error {
+	var lastErr error
+	sent := false
+
+	for start := 0; start < len(infoHashes); start += maxHashes {
+		batch := infoHashes[start:min(start+maxHashes, len(infoHashes))]
+
+		for i, conn := range s.conns {
+			msg := s.announceMsg(s.groups[i], batch)
+			if _, err := conn.WriteToUDP(msg, s.groups[i]); err != nil {
+				lastErr = err
+				continue
+			}
+			sent = true
+		}
+	}
+
+	if !sent && lastErr != nil {
+		return lastErr
+	}
+	return nil
+}
+
+func (s *Service) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+
+	close(s.closed)
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+// A BT-SEARCH message, formatted like an HTTP request.
+func (s *Service) announceMsg(group *net.UDPAddr, infoHashes [][20]byte) []byte {
+	b := strings.Builder{}
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", group)
+	fmt.Fprintf(&b, "Port: %d\r\n", s.port)
+	for _, ih := range infoHashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", ih)
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n", s.cookie)
+	b.WriteString("\r\n\r\n")
+	return []byte(b.String())
+}
+
+func (s *Service) readLoop(conn *net.UDPConn) {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				fmt.Printf("LSD stopped listening on %s: %v\n", conn.LocalAddr(), err)
+			}
+			return
+		}
+
+		port, infoHashes, cookie, err := parseAnnounce(buf[:n])
+		if err != nil || cookie == s.cookie {
+			continue
+		}
+
+		peer := &net.TCPAddr{IP: addr.IP, Port: port, Zone: addr.Zone}
+		for _, ih := range infoHashes {
+			s.mu.Lock()
+			onPeer := s.subs[ih]
+			s.mu.Unlock()
+
+			if onPeer != nil {
+				onPeer(peer)
+			}
+		}
+	}
+}
+
+// Parse a BT-SEARCH message into its port, info hashes and cookie.
+// Header names are case-insensitive; unknown headers are skipped.
+func parseAnnounce(data []byte) (int, [][20]byte, string, error) {
+	sc := bufio.NewScanner(strings.NewReader(string(data)))
+
+	if !sc.Scan() || strings.TrimSpace(sc.Text()) != "BT-SEARCH * HTTP/1.1" {
+		return 0, nil, "", errors.New("not a BT-SEARCH message")
+	}
+
+	port := 0
+	cookie := ""
+	infoHashes := [][20]byte{}
+
+	for sc.Scan() {
+		name, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "port":
+			p, err := strconv.Atoi(value)
+			if err != nil || p <= 0 || p > 65535 {
+				return 0, nil, "", fmt.Errorf("invalid port %q", value)
+			}
+			port = p
+		case "infohash":
+			var ih [20]byte
+			if b, err := hex.DecodeString(value); err == nil && len(b) == len(ih) {
+				copy(ih[:], b)
+				infoHashes = append(infoHashes, ih)
+			}
+		case "cookie":
+			cookie = value
+		}
+	}
+
+	if port == 0 || len(infoHashes) == 0 {
+		return 0, nil, "", errors.New("BT-SEARCH message without port or info hash")
+	}
+	return port, infoHashes, cookie, nil
+}
@@ -1,22 +1,575 @@
-package main
-
-import (
-	"github.com/AcidOP/torrly/torrent"
-)
-
-func main() {
-	t1, err := torrent.NewTorrentFromFile("./test.torrent")
-	if err != nil {
-		panic(err)
-	}
-
-	t1.ViewTorrent()
-	t1.StartDownload()
-
-	// t2, err := torrent.NewTorrentFromFile("./test.torrent")
-	// if err != nil {
-	// 	panic(err)
-	// }
-
-	// t2.ViewTorrent()
-}
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AcidOP/torrly/dht"
+	"github.com/AcidOP/torrly/lsd"
+	"github.com/AcidOP/torrly/peers"
+	"github.com/AcidOP/torrly/torrent"
+	"github.com/AcidOP/torrly/tracker"
+)
+
+const usage = `Usage: torrly <command> [arguments]
+
+Commands:
+  download [tracker options] [dht options] [-no-lsd] [-dir directory] <file.torrent | magnet URI>
+  magnet2torrent [-o output.torrent] [tracker options] [dht options] <magnet URI>
+  create [options] <file | directory>
+  scrape [tracker options] <file.torrent | magnet URI>...
+  tracker serve [-addr :6969] [-interval 30m] [-allow <info hash | file.torrent>]...
+  dht export [-dht-state file] [-o nodes.dat]
+  dht import [-dht-state file] <nodes.dat>...
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+
+	var err error
+
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "download":
+		err = download(args)
+	case "magnet2torrent":
+		err = magnetToTorrent(args)
+	case "create":
+		err = create(args)
+	case "scrape":
+		err = scrape(args)
+	case "tracker":
+		err = trackerCmd(args)
+	case "dht":
+		err = dhtCmd(args)
+	default:
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+// Load a torrent from either a .torrent file path or a magnet URI.
+func loadTorrent(src string) (*torrent.Torrent, error) {
+	if strings.HasPrefix(src, "magnet:") {
+		return torrent.NewTorrentFromMagnet(src)
+	}
+	return torrent.NewTorrentFromFile(src)
+}
+
+func download(args []string) error {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	tf := addTrackerFlags(fs)
+	df := addDHTFlags(fs)
+	noLSD := fs.Bool("no-lsd", false, "do not look for peers on the local network")
+	dir := fs.String("dir", ".", "directory to save the downloaded files in")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("download expects exactly one torrent file or magnet URI")
+	}
+	if err := tf.apply(); err != nil {
+		return err
+	}
+
+	t, err := loadTorrent(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	t.DownloadDir = *dir
+
+	if t.DHT, err = df.start(); err != nil {
+		return err
+	}
+	if t.DHT != nil {
+		defer t.DHT.Close()
+	}
+
+	// Not every network allows multicast, so go on without it
+	if !*noLSD {
+		if t.LSD, err = lsd.Listen(t.Port); err != nil {
+			fmt.Println("Local service discovery disabled:", err)
+		} else {
+			defer t.LSD.Close()
+		}
+	}
+
+	t.ViewTorrent()
+
+	// Tell the trackers we are leaving on Ctrl-C
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		fmt.Println("Stopping...")
+		t.Stop()
+	}()
+
+	t.StartDownload()
+	return nil
+}
+
+// Fetch the metadata of a magnet link from the swarm,
+// write it out as a .torrent file and stop.
+func magnetToTorrent(args []string) error {
+	fs := flag.NewFlagSet("magnet2torrent", flag.ExitOnError)
+	out := fs.String("o", "", "output .torrent path (defaults to <name>.torrent)")
+	tf := addTrackerFlags(fs)
+	df := addDHTFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("magnet2torrent expects exactly one magnet URI")
+	}
+	if err := tf.apply(); err != nil {
+		return err
+	}
+
+	t, err := torrent.NewTorrentFromMagnet(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if t.DHT, err = df.start(); err != nil {
+		return err
+	}
+	if t.DHT != nil {
+		defer t.DHT.Close()
+	}
+
+	if err := t.FetchMetadata(); err != nil {
+		return err
+	}
+
+	path := *out
+	if path == "" {
+		path = fmt.Sprintf("%x.torrent", t.InfoHash)
+		if t.Name != "" {
+			path = filepath.Base(t.Name) + ".torrent"
+		}
+	}
+
+	if err := t.WriteTorrentFile(path); err != nil {
+		return err
+	}
+
+	fmt.Println("Wrote", path)
+	return nil
+}
+
+// Flags configuring the DHT node of the commands that look for peers.
+type dhtFlags struct {
+	disable   *bool
+	addr      *string
+	state     *string
+	bootstrap listFlag
+}
+
+func addDHTFlags(fs *flag.FlagSet) *dhtFlags {
+	df := &dhtFlags{
+		disable: fs.Bool("no-dht", false, "do not look for peers on the DHT"),
+		addr:    fs.String("dht-addr", ":6881", "UDP address of the DHT node"),
+		state:   addDHTStateFlag(fs),
+	}
+	fs.Var(&df.bootstrap, "dht-bootstrap", "host:port of a DHT node to bootstrap from, replaces the defaults (repeatable)")
+	return df
+}
+
+// Start the DHT node, or return nil if it is disabled.
+func (df *dhtFlags) start() (*dht.Node, error) {
+	if *df.disable {
+		return nil, nil
+	}
+
+	bootstrap := dht.DefaultBootstrapNodes
+	if len(df.bootstrap) > 0 {
+		bootstrap = df.bootstrap
+	}
+	return dht.NewNode(dht.Config{
+		Addr:           *df.addr,
+		BootstrapNodes: bootstrap,
+		StateFile:      *df.state,
+		OnExternalIP:   peers.SetExternalIP,
+	})
+}
+
+func addDHTStateFlag(fs *flag.FlagSet) *string {
+	path := ""
+	if dir, err := os.UserCacheDir(); err == nil {
+		path = filepath.Join(dir, "torrly", "dht.dat")
+	}
+	return fs.String("dht-state", path, "file the DHT routing table is kept in, empty to not keep it")
+}
+
+// Flags configuring the HTTP client of the commands that talk to trackers.
+type trackerFlags struct {
+	timeout   *time.Duration
+	proxy     *string
+	caFile    *string
+	userAgent *string
+	headers   listFlag
+	cookies   listFlag
+	rewrites  listFlag
+}
+
+func addTrackerFlags(fs *flag.FlagSet) *trackerFlags {
+	tf := &trackerFlags{
+		timeout:   fs.Duration("tracker-timeout", 30*time.Second, "timeout of tracker requests"),
+		proxy:     fs.String("proxy", "", "http://, https:// or socks5:// proxy for trackers"),
+		caFile:    fs.String("ca-file", "", "PEM file of extra CAs to trust for trackers"),
+		userAgent: fs.String("user-agent", torrent.DefaultUserAgent, "User-Agent sent to trackers"),
+	}
+	fs.Var(&tf.headers, "header", "extra header as host=Name: value (repeatable)")
+	fs.Var(&tf.cookies, "cookie", "cookie as host=name=value (repeatable)")
+	fs.Var(&tf.rewrites, "rewrite", "replace text in tracker URLs as host=old=new, empty host for all (repeatable)")
+	return tf
+}
+
+// Configure the tracker client from the flags.
+func (tf *trackerFlags) apply() error {
+	cfg := torrent.TrackerClientConfig{
+		Timeout:   *tf.timeout,
+		Proxy:     *tf.proxy,
+		CAFile:    *tf.caFile,
+		UserAgent: *tf.userAgent,
+		Headers:   map[string]http.Header{},
+		Cookies:   map[string][]*http.Cookie{},
+	}
+
+	for _, h := range tf.headers {
+		host, header, ok := strings.Cut(h, "=")
+		name, value, ok2 := strings.Cut(header, ":")
+		if !ok || !ok2 {
+			return fmt.Errorf("invalid -header %q, expected host=Name: value", h)
+		}
+		if cfg.Headers[host] == nil {
+			cfg.Headers[host] = http.Header{}
+		}
+		cfg.Headers[host].Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	for _, c := range tf.cookies {
+		host, cookie, ok := strings.Cut(c, "=")
+		name, value, ok2 := strings.Cut(cookie, "=")
+		if !ok || !ok2 {
+			return fmt.Errorf("invalid -cookie %q, expected host=name=value", c)
+		}
+		cfg.Cookies[host] = append(cfg.Cookies[host], &http.Cookie{Name: name, Value: value})
+	}
+
+	for _, r := range tf.rewrites {
+		parts := strings.SplitN(r, "=", 3)
+		if len(parts) != 3 || parts[1] == "" {
+			return fmt.Errorf("invalid -rewrite %q, expected host=old=new", r)
+		}
+		cfg.Rewrites = append(cfg.Rewrites, torrent.RewriteRule{Host: parts[0], Old: parts[1], New: parts[2]})
+	}
+
+	client, err := torrent.NewTrackerClient(cfg)
+	if err != nil {
+		return err
+	}
+	torrent.SetTrackerClient(client)
+	return nil
+}
+
+// Repeatable string flag (e.g. -a url1 -a url2).
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// Create a .torrent file from a file or directory.
+func create(args []string) error {
+	// The creation date is left out by default so the same files always
+	// give the same torrent, SOURCE_DATE_EPOCH pins it for reproducible builds
+	var defaultDate int64
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		v, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH: %v", err)
+		}
+		defaultDate = v
+	}
+
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	out := fs.String("o", "", "output .torrent path (defaults to <name>.torrent)")
+	name := fs.String("name", "", "torrent name (defaults to the base name of the path)")
+	pieceLength := fs.Int("piece-length", 0, "piece length in bytes (0 picks one automatically)")
+	comment := fs.String("comment", "", "comment")
+	createdBy := fs.String("created-by", "torrly", "created by")
+	date := fs.Int64("date", defaultDate, "creation date as a unix timestamp, 0 to omit (defaults to $SOURCE_DATE_EPOCH)")
+	private := fs.Bool("private", false, "mark the torrent as private (BEP 27)")
+	source := fs.String("source", "", "source tag")
+
+	var trackers, webSeeds listFlag
+	fs.Var(&trackers, "a", "tracker tier as comma separated announce URLs (repeatable)")
+	fs.Var(&webSeeds, "w", "web seed URL (repeatable)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("create expects exactly one file or directory")
+	}
+
+	opts := torrent.CreateOptions{
+		PieceLength: *pieceLength,
+		Name:        *name,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		Source:      *source,
+		URLList:     webSeeds,
+	}
+
+	if *date != 0 {
+		opts.CreationDate = time.Unix(*date, 0)
+	}
+
+	for _, tier := range trackers {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+	if len(opts.AnnounceList) > 0 {
+		opts.Announce = opts.AnnounceList[0][0]
+	}
+	// A single tracker doesn't need an announce-list
+	if len(opts.AnnounceList) == 1 && len(opts.AnnounceList[0]) == 1 {
+		opts.AnnounceList = nil
+	}
+
+	data, err := torrent.Create(fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+
+	path := *out
+	if path == "" {
+		root, err := filepath.Abs(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		path = filepath.Base(root) + ".torrent"
+		if *name != "" {
+			path = filepath.Base(*name) + ".torrent"
+		}
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return err
+	}
+
+	fmt.Println("Wrote", path)
+	return nil
+}
+
+// Print the seeder and leecher counts of torrents, as reported by each of
+// their trackers. Torrents sharing a tracker are scraped in one request.
+func scrape(args []string) error {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	tf := addTrackerFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("scrape expects at least one torrent file or magnet URI")
+	}
+	if err := tf.apply(); err != nil {
+		return err
+	}
+
+	torrents := []*torrent.Torrent{}
+	for _, src := range fs.Args() {
+		t, err := loadTorrent(src)
+		if err != nil {
+			return fmt.Errorf("%s: %v", src, err)
+		}
+		torrents = append(torrents, t)
+	}
+
+	results, errs := torrent.ScrapeMany(torrents)
+
+	for i, t := range torrents {
+		name := t.Name
+		if name == "" {
+			name = fmt.Sprintf("%x", t.InfoHash)
+		}
+
+		fmt.Println("📊 Scrape:", name)
+		fmt.Println()
+		for _, ts := range t.Trackers() {
+			fmt.Println("  📡", ts.URL)
+			if res, ok := results[i][ts.URL]; ok {
+				res.Show()
+			} else if err, ok := errs[ts.URL]; ok {
+				fmt.Println("    ❌", err)
+			} else {
+				fmt.Println("    ❔ Torrent not known to the tracker")
+			}
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func trackerCmd(args []string) error {
+	if len(args) == 0 || args[0] != "serve" {
+		return fmt.Errorf("usage: tracker serve [options]")
+	}
+	return trackerServe(args[1:])
+}
+
+// Run an HTTP tracker, e.g. for a private swarm on the local network.
+func trackerServe(args []string) error {
+	fs := flag.NewFlagSet("tracker serve", flag.ExitOnError)
+	addr := fs.String("addr", ":6969", "address to listen on")
+	interval := fs.Duration("interval", tracker.DefaultInterval, "re-announce interval handed to clients")
+	minInterval := fs.Duration("min-interval", 0, "minimum re-announce interval, 0 to leave out")
+
+	var allow listFlag
+	fs.Var(&allow, "allow", "only serve this torrent, as a hex info hash or .torrent file (repeatable)")
+	fs.Parse(args)
+
+	srv := tracker.NewServer()
+	srv.Interval = *interval
+	srv.MinInterval = *minInterval
+	srv.PeerTTL = 2 * *interval
+
+	for _, a := range allow {
+		ih, err := allowedHash(a)
+		if err != nil {
+			return err
+		}
+		srv.Allow(ih)
+	}
+
+	fmt.Printf("Tracker listening on %s (announce URL http://<host>%s/announce)\n", *addr, portOf(*addr))
+	return srv.ListenAndServe(*addr)
+}
+
+func dhtCmd(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			return dhtExport(args[1:])
+		case "import":
+			return dhtImport(args[1:])
+		}
+	}
+	return fmt.Errorf("usage: dht export|import [options]")
+}
+
+// Write the nodes of the saved routing table to a node list,
+// to seed the routing table of another machine with.
+func dhtExport(args []string) error {
+	fs := flag.NewFlagSet("dht export", flag.ExitOnError)
+	state := addDHTStateFlag(fs)
+	out := fs.String("o", "", "output file (defaults to stdout)")
+	fs.Parse(args)
+
+	f, err := os.Open(*state)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	nodes, err := dht.ReadNodes(f)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+
+	if err := dht.WriteNodes(w, nodes); err != nil {
+		return err
+	}
+
+	if *out != "" {
+		fmt.Printf("Exported %d DHT nodes to %s\n", len(nodes), *out)
+	}
+	return nil
+}
+
+// Add the nodes of node lists to the saved routing table.
+// They are pinged the next time the DHT node starts.
+func dhtImport(args []string) error {
+	fs := flag.NewFlagSet("dht import", flag.ExitOnError)
+	state := addDHTStateFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("dht import expects at least one node list")
+	}
+	if *state == "" {
+		return fmt.Errorf("dht import needs a -dht-state file")
+	}
+
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		nodes, err := dht.ReadNodes(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		if err := dht.MergeNodes(*state, nodes); err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d DHT nodes from %s\n", len(nodes), path)
+	}
+	return nil
+}
+
+// Parse an -allow value, either a hex info hash or the path of a .torrent file.
+func allowedHash(v string) ([20]byte, error) {
+	var ih [20]byte
+	if b, err := hex.DecodeString(v); err == nil && len(b) == len(ih) {
+		copy(ih[:], b)
+		return ih, nil
+	}
+
+	t, err := torrent.NewTorrentFromFile(v)
+	if err != nil {
+		return ih, fmt.Errorf("-allow %s: %v", v, err)
+	}
+
+	// v2-only torrents announce the truncated SHA-256 info hash
+	if !t.HasV1 {
+		return t.InfoHashV2Short(), nil
+	}
+	return t.InfoHash, nil
+}
+
+// The ":port" part of a listen address, for printing the announce URL.
+func portOf(addr string) string {
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return ":" + port
+	}
+	return ""
+}
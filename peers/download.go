@@ -0,0 +1,228 @@
+package peers
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/AcidOP/torrly/messages"
+)
+
+const (
+	BlockSize = 16 * 1024 // Size of the blocks pieces are requested in
+
+	maxPendingRequests = 16         // Requests we keep in flight with each peer
+	maxRequestLength   = 128 * 1024 // Longest block we serve, clients request 16 KB
+)
+
+// Store is where the pieces downloaded from peers go to and where the
+// blocks requested by peers come from. It is shared by every peer of a
+// torrent and called from their read loops concurrently.
+type Store interface {
+	// Pieces we have, sent to peers after the handshake
+	Bitfield() []bool
+	// Reserve a piece we need out of those the peer has
+	Pick(has []bool) (index, length int, ok bool)
+	// Give back a picked piece that will not be completed
+	Release(index int)
+	// Hand over a downloaded piece, false if it failed its hash check and
+	// has to be picked again
+	Complete(index int, data []byte) bool
+	// Read a block of a piece we have
+	ReadBlock(index, begin, length int) ([]byte, error)
+}
+
+// A piece being downloaded from a peer.
+type pieceDownload struct {
+	index    int
+	data     []byte
+	next     int    // Offset of the next block to request
+	pending  int    // Blocks requested but not received yet
+	received []bool // Blocks received so far
+	left     int    // Blocks still missing
+}
+
+func newPieceDownload(index, length int) *pieceDownload {
+	blocks := (length + BlockSize - 1) / BlockSize
+	return &pieceDownload{
+		index:    index,
+		data:     make([]byte, length),
+		received: make([]bool, blocks),
+		left:     blocks,
+	}
+}
+
+func (p *Peer) SendUnchoke() error {
+	msg := messages.Message{ID: messages.MsgUnchoke}
+	return p.send(&msg)
+}
+
+// SendHave tells the peer we have completed a piece.
+func (p *Peer) SendHave(index int) error {
+	msg := messages.Message{
+		ID:      messages.MsgHave,
+		Payload: binary.BigEndian.AppendUint32(nil, uint32(index)),
+	}
+	return p.send(&msg)
+}
+
+// SendBitfield tells the peer which pieces we have.
+// Nothing is sent if we have none of them.
+func (p *Peer) SendBitfield(have []bool) error {
+	payload := make([]byte, (len(have)+7)/8)
+	empty := true
+	for i, ok := range have {
+		if ok {
+			payload[i/8] |= 0x80 >> (i % 8)
+			empty = false
+		}
+	}
+	if empty {
+		return nil
+	}
+
+	msg := messages.Message{ID: messages.MsgBitfield, Payload: payload}
+	return p.send(&msg)
+}
+
+func (p *Peer) sendPiece(index, begin int, block []byte) error {
+	payload := make([]byte, 8, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+
+	msg := messages.Message{ID: messages.MsgPiece, Payload: append(payload, block...)}
+	return p.send(&msg)
+}
+
+// The peer has a new piece. Only tracked while we download.
+func (p *Peer) setHave(index int) error {
+	if p.store == nil {
+		return nil
+	}
+	if index >= len(p.store.Bitfield()) {
+		return fmt.Errorf("peer %s has piece %d, which is out of range", p.IP.String(), index)
+	}
+
+	if index >= len(p.Bitfield) {
+		p.Bitfield = append(p.Bitfield, make([]bool, index+1-len(p.Bitfield))...)
+	}
+	p.Bitfield[index] = true
+	return nil
+}
+
+// Tell the peer we are interested as soon as it has a piece we need.
+func (p *Peer) updateInterest() error {
+	if p.store == nil || p.interested {
+		return nil
+	}
+
+	have := p.store.Bitfield()
+	for i, ok := range p.Bitfield {
+		if ok && i < len(have) && !have[i] {
+			p.interested = true
+			return p.SendInterested()
+		}
+	}
+	return nil
+}
+
+// Keep requests in flight while the peer lets us download,
+// picking a new piece once the current one is complete.
+func (p *Peer) requestBlocks() error {
+	if p.store == nil || p.choked {
+		return nil
+	}
+
+	if p.piece == nil {
+		index, length, ok := p.store.Pick(p.Bitfield)
+		if !ok {
+			return nil
+		}
+		p.piece = newPieceDownload(index, length)
+	}
+
+	pd := p.piece
+	for pd.pending < maxPendingRequests && pd.next < len(pd.data) {
+		length := min(BlockSize, len(pd.data)-pd.next)
+		if err := p.SendRequest(pd.index, length, pd.next); err != nil {
+			return err
+		}
+		pd.next += length
+		pd.pending++
+	}
+	return nil
+}
+
+// Store a block of the piece being downloaded, and hand the piece over
+// once every block arrived.
+func (p *Peer) handleBlock(payload []byte) error {
+	if len(payload) < 8 {
+		return fmt.Errorf("piece message of %d bytes from peer %s", len(payload), p.IP.String())
+	}
+
+	index := int(binary.BigEndian.Uint32(payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(payload[4:8]))
+	block := payload[8:]
+
+	// Blocks we no longer wait for, e.g. requested before a choke
+	pd := p.piece
+	if pd == nil || index != pd.index || begin%BlockSize != 0 || begin >= pd.next {
+		return nil
+	}
+	if len(block) != min(BlockSize, len(pd.data)-begin) || pd.received[begin/BlockSize] {
+		return nil
+	}
+
+	copy(pd.data[begin:], block)
+	pd.received[begin/BlockSize] = true
+	pd.pending--
+	pd.left--
+
+	if pd.left == 0 {
+		p.piece = nil
+		if !p.store.Complete(pd.index, pd.data) {
+			fmt.Printf("Piece %d from peer %s failed its hash check\n", pd.index, p.IP.String())
+		} else if p.onHave != nil {
+			p.onHave(pd.index)
+		}
+	}
+	return p.requestBlocks()
+}
+
+// Requests in flight are dropped when the peer chokes us.
+func (p *Peer) releasePiece() {
+	if p.piece != nil {
+		p.store.Release(p.piece.index)
+		p.piece = nil
+	}
+}
+
+// Serve a block the peer asked for, if we let it download from us.
+func (p *Peer) handleRequest(payload []byte) error {
+	if len(payload) != 12 {
+		return fmt.Errorf("request message of %d bytes from peer %s", len(payload), p.IP.String())
+	}
+	if p.store == nil || !p.peerUnchoked {
+		return nil
+	}
+
+	index := int(binary.BigEndian.Uint32(payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(payload[4:8]))
+	length := int(binary.BigEndian.Uint32(payload[8:12]))
+	if length == 0 || length > maxRequestLength {
+		return fmt.Errorf("peer %s requested a block of %d bytes", p.IP.String(), length)
+	}
+
+	block, err := p.store.ReadBlock(index, begin, length)
+	if err != nil {
+		fmt.Printf("Cannot serve piece %d to peer %s: %v\n", index, p.IP.String(), err)
+		return nil
+	}
+
+	if err := p.sendPiece(index, begin, block); err != nil {
+		return err
+	}
+	if p.onUpload != nil {
+		p.onUpload(len(block))
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package peers
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore keeps the pieces of a torrent in memory.
+type memStore struct {
+	pieceLength int
+	data        []byte
+
+	mu       sync.Mutex
+	have     []bool
+	picked   []bool
+	complete chan struct{} // Closed once every piece is there
+}
+
+func newMemStore(data []byte, pieceLength int, seed bool) *memStore {
+	n := (len(data) + pieceLength - 1) / pieceLength
+	s := &memStore{
+		pieceLength: pieceLength,
+		data:        make([]byte, len(data)),
+		have:        make([]bool, n),
+		picked:      make([]bool, n),
+		complete:    make(chan struct{}),
+	}
+	if seed {
+		copy(s.data, data)
+		for i := range s.have {
+			s.have[i] = true
+		}
+	}
+	return s
+}
+
+func (s *memStore) Bitfield() []bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bool{}, s.have...)
+}
+
+func (s *memStore) Pick(has []bool) (int, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, ok := range has {
+		if ok && i < len(s.have) && !s.have[i] && !s.picked[i] {
+			s.picked[i] = true
+			begin := i * s.pieceLength
+			return i, min(s.pieceLength, len(s.data)-begin), true
+		}
+	}
+	return 0, 0, false
+}
+
+func (s *memStore) Release(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.picked[index] = false
+}
+
+func (s *memStore) Complete(index int, data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.picked[index] = false
+	copy(s.data[index*s.pieceLength:], data)
+	s.have[index] = true
+
+	for _, ok := range s.have {
+		if !ok {
+			return true
+		}
+	}
+	close(s.complete)
+	return true
+}
+
+func (s *memStore) ReadBlock(index, begin, length int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.have[index] {
+		return nil, errors.New("piece missing")
+	}
+	offset := index*s.pieceLength + begin
+	return append([]byte{}, s.data[offset:offset+length]...), nil
+}
+
+// Two peers connected to each other over loopback TCP.
+func peerPair(t *testing.T) (*Peer, *Peer) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Peer{IP: net.IPv4(127, 0, 0, 1), Port: 1, conn: dialed, choked: true}
+	b := &Peer{IP: net.IPv4(127, 0, 0, 1), Port: 2, conn: <-accepted, choked: true}
+	return a, b
+}
+
+func TestPieceExchange(t *testing.T) {
+	data := make([]byte, 3*BlockSize*2+1234) // Last piece shorter than the others
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	seed := newMemStore(data, 2*BlockSize, true)
+	leech := newMemStore(data, 2*BlockSize, false)
+
+	seeder, leecher := peerPair(t)
+	seeder.store = seed
+	leecher.store = leech
+
+	uploaded := 0
+	seeder.onUpload = func(n int) { uploaded += n }
+
+	var wg sync.WaitGroup
+	for _, p := range []*Peer{seeder, leecher} {
+		wg.Add(1)
+		go func(p *Peer) {
+			defer wg.Done()
+			p.ReadLoop()
+		}(p)
+	}
+
+	if err := seeder.SendBitfield(seed.Bitfield()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-leech.complete:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("download incomplete, have %v", leech.Bitfield())
+	}
+
+	seeder.conn.Close()
+	leecher.conn.Close()
+	wg.Wait()
+
+	if !bytes.Equal(leech.data, data) {
+		t.Error("downloaded data differs from the original")
+	}
+	if uploaded != len(data) {
+		t.Errorf("uploaded %d bytes, want %d", uploaded, len(data))
+	}
+}
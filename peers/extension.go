@@ -0,0 +1,123 @@
+package peers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/AcidOP/torrly/bencode"
+	"github.com/AcidOP/torrly/messages"
+)
+
+// Extended message IDs we assign to the extensions we support.
+// Peers use these IDs when sending extended messages to us.
+// https://www.bittorrent.org/beps/bep_0010.html
+const (
+	ExtHandshakeID  = 0
+	ExtUtMetadataID = 1
+	ExtUtPexID      = 2
+)
+
+const clientVersion = "torrly 0.1"
+
+type extHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	V            string         `bencode:"v,omitempty"`
+	YourIP       []byte         `bencode:"yourip,omitempty"` // The receiver's address, as seen by the sender
+	IPv4         []byte         `bencode:"ipv4,omitempty"`   // The sender's public IPv4 address
+	IPv6         []byte         `bencode:"ipv6,omitempty"`   // The sender's public IPv6 address
+}
+
+// sendExtended sends an extended message with the given extended ID.
+// The payload is the bencoded dictionary (and any trailing data).
+func (p *Peer) sendExtended(extID byte, payload []byte) error {
+	msg := messages.Message{
+		ID:      messages.MsgExtended,
+		Payload: append([]byte{extID}, payload...),
+	}
+	return p.send(&msg)
+}
+
+// SendExtHandshake sends our extension handshake, advertising the
+// extensions we support. `metadataSize` is 0 if we don't have the metadata.
+func (p *Peer) SendExtHandshake(metadataSize int) error {
+	hs := extHandshake{
+		M:            map[string]int{"ut_metadata": ExtUtMetadataID},
+		MetadataSize: metadataSize,
+		V:            clientVersion,
+		YourIP:       compactIP(p.IP),
+	}
+	if p.onPex != nil {
+		hs.M["ut_pex"] = ExtUtPexID
+	}
+
+	// Tell the peer our public address, if a tracker told us
+	if ip := ExternalIP(); ip.To4() != nil {
+		hs.IPv4 = ip.To4()
+	} else if ip != nil {
+		hs.IPv6 = ip.To16()
+	}
+
+	payload, err := bencode.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	return p.sendExtended(ExtHandshakeID, payload)
+}
+
+// handleExtHandshake stores the extension IDs advertised by the peer.
+func (p *Peer) handleExtHandshake(payload []byte) error {
+	hs := extHandshake{}
+	if err := unmarshalLenient(payload, &hs); err != nil {
+		return fmt.Errorf("invalid extension handshake: %v", err)
+	}
+
+	p.extHandshake = true
+	p.extensions = hs.M
+	p.metadataSize = hs.MetadataSize
+
+	// Read by the PEX loop while the read loop runs
+	if id := hs.M["ut_pex"]; id > 0 && id < 256 {
+		atomic.StoreInt32(&p.pexID, int32(id))
+	}
+	return nil
+}
+
+// Decode a bencoded message from a peer. Not every client sorts its
+// dictionary keys.
+func unmarshalLenient(data []byte, v any) error {
+	d := bencode.NewDecoder(bytes.NewReader(data))
+	d.AllowUnsortedKeys()
+	return d.Decode(v)
+}
+
+// readExtended reads messages until an extended message arrives.
+// Other messages are skipped. Returns the extended ID and its payload.
+func (p *Peer) readExtended() (byte, []byte, error) {
+	for {
+		msg, err := p.Read()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if msg.ID != messages.MsgExtended {
+			continue
+		}
+
+		if len(msg.Payload) == 0 {
+			return 0, nil, errors.New("empty extended message")
+		}
+		return msg.Payload[0], msg.Payload[1:], nil
+	}
+}
+
+// Shortest binary form of an IP address: 4 bytes for IPv4, 16 for IPv6.
+func compactIP(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
@@ -0,0 +1,59 @@
+package peers
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExtHandshakeUnsortedKeys(t *testing.T) {
+	p := &Peer{}
+
+	// `v` before `m`, as some clients send it
+	payload := []byte("d1:v6:client1:md6:ut_pexi3e11:ut_metadatai2ee13:metadata_sizei1000ee")
+	if err := p.handleExtHandshake(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.extensions["ut_metadata"] != 2 || p.pexID != 3 || p.metadataSize != 1000 {
+		t.Errorf("extensions = %v, pex ID = %d, metadata size = %d", p.extensions, p.pexID, p.metadataSize)
+	}
+}
+
+func TestFetchMetadataWithoutUtMetadata(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake string
+	}{
+		{"no m", "d1:v4:teste"},
+		{"no ut_metadata", "d1:md6:ut_pexi1eee"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			local := &Peer{conn: a, supportsExtensions: true}
+			remote := &Peer{conn: b}
+
+			go func() {
+				if _, err := remote.Read(); err != nil {
+					return
+				}
+				remote.sendExtended(ExtHandshakeID, []byte(tt.handshake))
+			}()
+
+			start := time.Now()
+			if _, err := local.FetchMetadata(); err == nil {
+				t.Fatal("FetchMetadata succeeded without ut_metadata")
+			}
+
+			// Well before the 5 second read timeout
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("FetchMetadata gave up after %v", elapsed)
+			}
+		})
+	}
+}
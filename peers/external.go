@@ -0,0 +1,36 @@
+package peers
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+var (
+	externalMu sync.Mutex
+	externalIP net.IP
+)
+
+// SetExternalIP records our public address, e.g. as reported by a tracker
+// in its `external ip` key (BEP 24).
+// https://www.bittorrent.org/beps/bep_0024.html
+func SetExternalIP(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	externalMu.Lock()
+	defer externalMu.Unlock()
+
+	if !ip.Equal(externalIP) {
+		fmt.Println("External IP:", ip.String())
+	}
+	externalIP = ip
+}
+
+// ExternalIP returns our public address, nil until it is known.
+func ExternalIP() net.IP {
+	externalMu.Lock()
+	defer externalMu.Unlock()
+	return externalIP
+}
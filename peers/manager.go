@@ -1,106 +1,342 @@
-package peers
-
-import (
-	"fmt"
-	"sync"
-
-	"github.com/AcidOP/torrly/handshake"
-	"github.com/AcidOP/torrly/messages"
-)
-
-type PeerManager struct {
-	peers          []Peer
-	infoHash       []byte
-	peerId         []byte
-	connectedPeers []*Peer
-}
-
-func NewPeerManager(peers []Peer, infoHash, peerId []byte) *PeerManager {
-	return &PeerManager{
-		peers:    peers,
-		infoHash: infoHash,
-		peerId:   peerId,
-	}
-}
-
-func (pm *PeerManager) HandlePeers() {
-	hs, err := handshake.NewHandshake(pm.infoHash, pm.peerId)
-	if err != nil {
-		fmt.Println("Error creating handshake:", err)
-		return
-	}
-
-	var wg sync.WaitGroup
-
-	for i := range pm.peers {
-		p := &pm.peers[i]
-
-		if err := p.connect(); err != nil {
-			fmt.Println("Error connecting to peer:", err)
-			continue
-		}
-
-		if err = hs.ExchangeHandshake(p.conn); err != nil {
-			p.conn.Close()
-			fmt.Println("Handshake failed:", err)
-			continue
-		}
-
-		if err := pm.AddPeer(p); err != nil {
-			fmt.Printf("Error adding peer %s: %v\n", p.IP.String(), err)
-			p.conn.Close()
-			continue
-		}
-
-		wg.Add(1)
-		go func(p *Peer) {
-			defer wg.Done()
-			if err := p.ReadLoop(); err != nil {
-				fmt.Printf("Error reading from peer %s: %v\n", p.IP.String(), err)
-				p.conn.Close()
-			}
-		}(p)
-	}
-
-	wg.Wait()
-}
-
-func (pm *PeerManager) AddPeer(p *Peer) error {
-	if p.IP == nil || p.Port <= 0 || p.Port > 65535 || p.conn == nil {
-		return fmt.Errorf("invalid peer: %v", p)
-	}
-
-	// Check if the peer already exists
-	for _, existingPeer := range pm.connectedPeers {
-		if existingPeer.IP.Equal(p.IP) {
-			return fmt.Errorf("peer already exists: %s", p.IP)
-		}
-	}
-
-	pm.connectedPeers = append(pm.connectedPeers, p)
-	return nil
-}
-
-func (pm *PeerManager) RemovePeer(p Peer) error {
-	for i, existingPeer := range pm.peers {
-		if existingPeer.IP.Equal(p.IP) {
-			if existingPeer.conn != nil {
-				existingPeer.conn.Close()
-			}
-			pm.peers = append(pm.peers[:i], pm.peers[i+1:]...)
-			return nil
-		}
-	}
-	return fmt.Errorf("peer not found: %s", p.IP)
-}
-
-func (pm *PeerManager) BroadcastMessage(msg *messages.Message) {
-	for _, peer := range pm.connectedPeers {
-		if err := peer.send(msg); err != nil {
-			fmt.Printf("Error sending message to peer %s: %v\n", peer.IP.String(), err)
-			continue
-		}
-
-		fmt.Printf("Broadcasted message (%s) to peer: %s\n", msg.String(), peer.IP.String())
-	}
-}
+package peers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AcidOP/torrly/handshake"
+	"github.com/AcidOP/torrly/messages"
+)
+
+type PeerManager struct {
+	peers          []Peer
+	infoHash       []byte
+	peerId         []byte
+	connectedPeers []*Peer
+
+	Port       int                 // Port we listen on, to recognise our own address
+	DHTPort    int                 // UDP port of our DHT node, 0 if we don't run one
+	OnUpload   func(n int)         // Called with the size of every block sent
+	OnPeerLost func(connected int) // Called with the number of peers left after one disconnects
+	OnDHTNode  func(addr string)   // Called with the DHT node address of peers that send a PORT message
+	PEX        bool                // Exchange peers with the connected peers (BEP 11) and dial the ones learned
+	Store      Store               // Pieces to download and serve, nil to only look for peers
+
+	mu        sync.Mutex
+	pexDialed map[string]time.Time // When peers learned through PEX were last dialed
+	wg        sync.WaitGroup       // Running read loops
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func NewPeerManager(peers []Peer, infoHash, peerId []byte) *PeerManager {
+	return &PeerManager{
+		peers:    peers,
+		infoHash: infoHash,
+		peerId:   peerId,
+		closed:   make(chan struct{}),
+	}
+}
+
+// HandlePeers connects to the initial peers and keeps the swarm running
+// until Close is called. More peers can be added with Connect meanwhile.
+func (pm *PeerManager) HandlePeers() {
+	if pm.PEX {
+		pm.wg.Add(1)
+		go pm.pexLoop()
+	}
+
+	pm.Connect(pm.peers)
+
+	<-pm.closed
+
+	pm.mu.Lock()
+	for _, p := range pm.connectedPeers {
+		p.conn.Close()
+	}
+	pm.mu.Unlock()
+
+	pm.wg.Wait()
+}
+
+// Connect dials the given peers, local ones first, and starts reading from
+// the ones that complete the handshake. Peers we are already connected to
+// are skipped.
+func (pm *PeerManager) Connect(pArr []Peer) {
+	hs, err := pm.newHandshake()
+	if err != nil {
+		fmt.Println("Error creating handshake:", err)
+		return
+	}
+
+	pArr = slices.Clone(pArr)
+	slices.SortStableFunc(pArr, func(a, b Peer) int {
+		if a.Local == b.Local {
+			return 0
+		}
+		if a.Local {
+			return -1
+		}
+		return 1
+	})
+
+	for i := range pArr {
+		p := &pArr[i]
+
+		if pm.isClosed() {
+			return
+		}
+		if pm.isConnected(p) || pm.isSelf(p) {
+			continue
+		}
+
+		if err := pm.dial(p, hs); err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		if err := pm.AddPeer(p); err != nil {
+			fmt.Printf("Error adding peer %s: %v\n", p.IP.String(), err)
+			p.conn.Close()
+			continue
+		}
+
+		p.onUpload = pm.OnUpload
+		p.choked = true // Every connection starts out choked
+		if pm.Store != nil {
+			p.store = pm.Store
+			p.onHave = pm.broadcastHave
+			if err := p.SendBitfield(pm.Store.Bitfield()); err != nil {
+				fmt.Printf("Error sending bitfield to peer %s: %v\n", p.Addr(), err)
+			}
+		}
+		if pm.OnDHTNode != nil {
+			p.onDHTPort = func(port int) {
+				pm.OnDHTNode(net.JoinHostPort(p.IP.String(), strconv.Itoa(port)))
+			}
+		}
+
+		if pm.PEX && p.supportsExtensions {
+			p.onPex = pm.connectPexPeers
+			if err := p.SendExtHandshake(0); err != nil {
+				fmt.Printf("Error sending extension handshake to peer %s: %v\n", p.Addr(), err)
+			}
+		}
+
+		// Let peers running a DHT node add ours to their routing table
+		if pm.DHTPort != 0 && p.supportsDHT {
+			if err := p.SendPort(pm.DHTPort); err != nil {
+				fmt.Printf("Error sending port to peer %s: %v\n", p.Addr(), err)
+			}
+		}
+
+		pm.wg.Add(1)
+		go func(p *Peer) {
+			defer pm.wg.Done()
+			if err := p.ReadLoop(); err != nil {
+				fmt.Printf("Error reading from peer %s: %v\n", p.IP.String(), err)
+				p.conn.Close()
+			}
+			pm.dropPeer(p)
+		}(p)
+	}
+}
+
+func (pm *PeerManager) newHandshake() (*handshake.Handshake, error) {
+	hs, err := handshake.NewHandshake(pm.infoHash, pm.peerId)
+	if err != nil {
+		return nil, err
+	}
+
+	if pm.DHTPort != 0 {
+		hs.EnableDHT()
+	}
+	return hs, nil
+}
+
+// Close disconnects from every peer and makes HandlePeers return.
+func (pm *PeerManager) Close() {
+	pm.once.Do(func() { close(pm.closed) })
+}
+
+func (pm *PeerManager) isClosed() bool {
+	select {
+	case <-pm.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Trackers may hand us our own address back.
+func (pm *PeerManager) isSelf(p *Peer) bool {
+	ip := ExternalIP()
+	return ip != nil && ip.Equal(p.IP) && p.Port == pm.Port
+}
+
+func (pm *PeerManager) isConnected(p *Peer) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, existingPeer := range pm.connectedPeers {
+		if existingPeer.Addr() == p.Addr() {
+			return true
+		}
+	}
+	return false
+}
+
+// Forget a peer whose connection ended and report how many are left.
+func (pm *PeerManager) dropPeer(p *Peer) {
+	pm.mu.Lock()
+	for i, existingPeer := range pm.connectedPeers {
+		if existingPeer == p {
+			pm.connectedPeers = append(pm.connectedPeers[:i], pm.connectedPeers[i+1:]...)
+			break
+		}
+	}
+	connected := len(pm.connectedPeers)
+	pm.mu.Unlock()
+
+	if pm.OnPeerLost != nil && !pm.isClosed() {
+		pm.OnPeerLost(connected)
+	}
+}
+
+// FetchMetadata asks the peers one by one for the info dictionary
+// until one of them returns metadata accepted by `verify`.
+func (pm *PeerManager) FetchMetadata(verify func([]byte) error) ([]byte, error) {
+	hs, err := handshake.NewHandshake(pm.infoHash, pm.peerId)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pm.peers {
+		p := &pm.peers[i]
+
+		if err := pm.dial(p, hs); err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		metadata, err := p.FetchMetadata()
+		p.conn.Close()
+		if err != nil {
+			fmt.Printf("Failed to fetch metadata from peer %s: %v\n", p.IP.String(), err)
+			continue
+		}
+
+		if err := verify(metadata); err != nil {
+			fmt.Printf("Invalid metadata from peer %s: %v\n", p.IP.String(), err)
+			continue
+		}
+
+		fmt.Printf("Received %d bytes of metadata from peer %s\n", len(metadata), p.IP.String())
+		return metadata, nil
+	}
+
+	return nil, errors.New("no peer provided valid metadata")
+}
+
+// dial connects to the peer and exchanges handshakes.
+// The connection is closed if anything goes wrong.
+func (pm *PeerManager) dial(p *Peer, hs *handshake.Handshake) error {
+	if err := p.connect(); err != nil {
+		return fmt.Errorf("error connecting to peer: %v", err)
+	}
+
+	remote, err := hs.ExchangeHandshake(p.conn)
+	if err != nil {
+		p.conn.Close()
+		return fmt.Errorf("handshake failed: %v", err)
+	}
+
+	if bytes.Equal(remote.PeerID, pm.peerId) {
+		p.conn.Close()
+		return fmt.Errorf("peer %s is ourselves", p.Addr())
+	}
+
+	// The tracker told us who should be listening at this address
+	if len(p.ID) == handshake.PEER_ID_LENGTH && !bytes.Equal(p.ID, remote.PeerID) {
+		p.conn.Close()
+		return fmt.Errorf("peer %s sent peer id %q, expected %q", p.IP.String(), remote.PeerID, p.ID)
+	}
+
+	p.ID = remote.PeerID
+	p.supportsExtensions = remote.SupportsExtensions()
+	p.supportsDHT = remote.SupportsDHT()
+	return nil
+}
+
+func (pm *PeerManager) AddPeer(p *Peer) error {
+	if p.IP == nil || p.Port <= 0 || p.Port > 65535 || p.conn == nil {
+		return fmt.Errorf("invalid peer: %v", p)
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.isClosed() {
+		return errors.New("peer manager is closed")
+	}
+
+	// Check if the peer already exists. The same client may be reachable
+	// over both IPv4 and IPv6, in which case only its peer ID gives it away.
+	for _, existingPeer := range pm.connectedPeers {
+		if existingPeer.Addr() == p.Addr() {
+			return fmt.Errorf("peer already exists: %s", p.Addr())
+		}
+		if len(p.ID) > 0 && bytes.Equal(existingPeer.ID, p.ID) {
+			return fmt.Errorf("peer %s already connected as %s", p.Addr(), existingPeer.Addr())
+		}
+	}
+
+	pm.connectedPeers = append(pm.connectedPeers, p)
+	return nil
+}
+
+func (pm *PeerManager) RemovePeer(p Peer) error {
+	for i, existingPeer := range pm.peers {
+		if existingPeer.IP.Equal(p.IP) {
+			if existingPeer.conn != nil {
+				existingPeer.conn.Close()
+			}
+			pm.peers = append(pm.peers[:i], pm.peers[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("peer not found: %s", p.IP)
+}
+
+// Tell every connected peer about a piece we completed.
+func (pm *PeerManager) broadcastHave(index int) {
+	pm.mu.Lock()
+	connected := slices.Clone(pm.connectedPeers)
+	pm.mu.Unlock()
+
+	for _, p := range connected {
+		if err := p.SendHave(index); err != nil {
+			fmt.Printf("Error sending have to peer %s: %v\n", p.Addr(), err)
+		}
+	}
+}
+
+func (pm *PeerManager) BroadcastMessage(msg *messages.Message) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, peer := range pm.connectedPeers {
+		if err := peer.send(msg); err != nil {
+			fmt.Printf("Error sending message to peer %s: %v\n", peer.IP.String(), err)
+			continue
+		}
+
+		fmt.Printf("Broadcasted message (%s) to peer: %s\n", msg.String(), peer.IP.String())
+	}
+}
@@ -0,0 +1,167 @@
+package peers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/AcidOP/torrly/bencode"
+)
+
+// https://www.bittorrent.org/beps/bep_0009.html
+const (
+	MetadataPieceSize = 16 * 1024
+	maxMetadataSize   = 16 * 1024 * 1024
+
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// FetchMetadata downloads the info dictionary from the peer using the
+// `ut_metadata` extension. The peer MUST have completed the handshake.
+// The returned bytes are not verified against the info hash.
+func (p *Peer) FetchMetadata() ([]byte, error) {
+	if !p.supportsExtensions {
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+
+	if err := p.SendExtHandshake(0); err != nil {
+		return nil, err
+	}
+
+	// Wait for the peer's extension handshake. Its `m` may be missing,
+	// so don't wait for extensions to show up.
+	for !p.extHandshake {
+		id, payload, err := p.readExtended()
+		if err != nil {
+			return nil, err
+		}
+		if id == ExtHandshakeID {
+			if err := p.handleExtHandshake(payload); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	utMetadata, ok := p.extensions["ut_metadata"]
+	if !ok || utMetadata == 0 {
+		return nil, errors.New("peer does not support ut_metadata")
+	}
+
+	if p.metadataSize <= 0 || p.metadataSize > maxMetadataSize {
+		return nil, fmt.Errorf("invalid metadata size: %d", p.metadataSize)
+	}
+
+	metadata := make([]byte, p.metadataSize)
+	numPieces := (p.metadataSize + MetadataPieceSize - 1) / MetadataPieceSize
+
+	for piece := 0; piece < numPieces; piece++ {
+		if err := p.requestMetadataPiece(byte(utMetadata), piece); err != nil {
+			return nil, err
+		}
+
+		data, err := p.readMetadataPiece(piece)
+		if err != nil {
+			return nil, err
+		}
+		copy(metadata[piece*MetadataPieceSize:], data)
+	}
+
+	return metadata, nil
+}
+
+func (p *Peer) requestMetadataPiece(extID byte, piece int) error {
+	payload, err := bencode.Marshal(metadataMsg{MsgType: metadataRequest, Piece: piece})
+	if err != nil {
+		return err
+	}
+	return p.sendExtended(extID, payload)
+}
+
+// readMetadataPiece waits for the data message of the given piece.
+// The piece data directly follows the bencoded dictionary.
+func (p *Peer) readMetadataPiece(piece int) ([]byte, error) {
+	for {
+		id, payload, err := p.readExtended()
+		if err != nil {
+			return nil, err
+		}
+
+		if id != ExtUtMetadataID {
+			continue
+		}
+
+		d := bencode.NewDecoder(bytes.NewReader(payload))
+		d.AllowUnsortedKeys()
+
+		msg := metadataMsg{}
+		if err := d.Decode(&msg); err != nil {
+			return nil, fmt.Errorf("invalid ut_metadata message: %v", err)
+		}
+
+		switch msg.MsgType {
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected metadata piece %d", msg.Piece)
+		case metadataRequest:
+			if err := p.rejectMetadata(msg.Piece); err != nil {
+				return nil, err
+			}
+			continue
+		case metadataData:
+		default:
+			continue
+		}
+
+		if msg.Piece != piece {
+			continue
+		}
+
+		if msg.TotalSize != p.metadataSize {
+			return nil, fmt.Errorf("metadata size changed: %d != %d", msg.TotalSize, p.metadataSize)
+		}
+
+		data := payload[d.Offset():]
+
+		dataLen := min(MetadataPieceSize, p.metadataSize-piece*MetadataPieceSize)
+		if len(data) != dataLen {
+			return nil, fmt.Errorf("metadata piece %d has %d bytes, expected %d", piece, len(data), dataLen)
+		}
+		return data, nil
+	}
+}
+
+// Answer the ut_metadata requests of a peer. Other ut_metadata messages
+// outside FetchMetadata are ignored.
+func (p *Peer) handleMetadataRequest(payload []byte) error {
+	msg := metadataMsg{}
+	if err := unmarshalLenient(payload, &msg); err != nil {
+		return fmt.Errorf("invalid ut_metadata message: %v", err)
+	}
+
+	if msg.MsgType == metadataRequest {
+		return p.rejectMetadata(msg.Piece)
+	}
+	return nil
+}
+
+// Reject a metadata request, we don't serve the metadata yet. Without an
+// answer the peer would wait for the piece until it times out.
+func (p *Peer) rejectMetadata(piece int) error {
+	id := p.extensions["ut_metadata"]
+	if id <= 0 || id > 255 {
+		return nil // The peer can't receive ut_metadata messages
+	}
+
+	payload, err := bencode.Marshal(metadataMsg{MsgType: metadataReject, Piece: piece})
+	if err != nil {
+		return err
+	}
+	return p.sendExtended(byte(id), payload)
+}
@@ -0,0 +1,48 @@
+package peers
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AcidOP/torrly/bencode"
+	"github.com/AcidOP/torrly/messages"
+)
+
+func TestMetadataRequestRejected(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// The peer asked for ut_metadata messages under ID 3
+	local := &Peer{conn: a, extensions: map[string]int{"ut_metadata": 3}}
+	remote := &Peer{conn: b}
+
+	request, err := bencode.Marshal(metadataMsg{MsgType: metadataRequest, Piece: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- local.handleMessage(&messages.Message{
+			ID:      messages.MsgExtended,
+			Payload: append([]byte{ExtUtMetadataID}, request...),
+		})
+	}()
+
+	id, payload, err := remote.readExtended()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	msg := metadataMsg{}
+	if err := bencode.Unmarshal(payload, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if id != 3 || msg.MsgType != metadataReject || msg.Piece != 2 {
+		t.Errorf("answer = ID %d %+v, want a reject of piece 2 under ID 3", id, msg)
+	}
+}
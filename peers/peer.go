@@ -1,145 +1,189 @@
-package peers
-
-import (
-	"fmt"
-	"net"
-	"strconv"
-	"strings"
-	"time"
-
-	"github.com/AcidOP/torrly/messages"
-)
-
-type Peer struct {
-	IP       net.IP
-	Port     int
-	choked   bool
-	conn     net.Conn
-	Bitfield []bool
-}
-
-// Read function reads a `messages.Message` from the peer's connection.
-// (Optionally) accepts a timeout duration to set a read deadline.
-// If no timeout is provided, it defaults to 5 seconds.
-func (p *Peer) Read(timeout ...time.Duration) (*messages.Message, error) {
-	duration := 5 * time.Second // Default timeout
-	if len(timeout) > 0 {
-		duration = timeout[0]
-	}
-
-	p.conn.SetReadDeadline(time.Now().Add(duration))
-	defer p.conn.SetReadDeadline(time.Time{})
-
-	return messages.Receive(p.conn)
-}
-
-// ReadLoop continuously reads messages from the peer until an error occurs.
-// This call blocks until a message is received or an error occurs.
-func (p *Peer) ReadLoop() error {
-	for {
-		msg, err := p.Read(time.Second * 10)
-		if err != nil {
-			p.conn.Close()
-			return err
-		}
-
-		switch msg.ID {
-		case messages.MsgKeepAlive:
-			fmt.Println("Received keep-alive message from peer:", p.IP.String())
-			continue
-		case messages.MsgBitfield:
-			p.setBitfield(bytesToBoolSlice(msg.Payload))
-		case messages.MsgChoke:
-			p.choke()
-		case messages.MsgUnchoke:
-			p.unchoke()
-		case messages.MsgHave:
-			fmt.Printf("Peer %s has piece %d\n", p.IP.String(), len(msg.Payload))
-		case messages.MsgPiece:
-			fmt.Printf("Received %d bytes from peer %s\n", len(msg.Payload), p.IP.String())
-		case messages.MsgNotInterested:
-			fmt.Printf("Peer %s is not interested\n", p.IP.String())
-		default:
-			return fmt.Errorf("unknown message ID %d from peer %s", msg.ID, p.IP.String())
-		}
-	}
-}
-
-func (p *Peer) download(pieceIndex, pieceLength int) error {
-	if p.choked {
-		fmt.Println("Peer has choked us, skipping.")
-		return fmt.Errorf("peer has choked us")
-	}
-
-	fmt.Printf("Requesting piece %d from peer %s\n", pieceIndex, p.IP.String())
-
-	blockSize := 16 * 1024 // 16 KB
-	for begin := 0; begin < pieceLength; begin += blockSize {
-		length := blockSize
-		if begin+length > pieceLength {
-			length = pieceLength - begin
-		}
-
-		if err := p.SendRequest(pieceIndex, length, begin); err != nil {
-			return err
-		}
-
-		msg, err := p.Read()
-		if err != nil {
-			return err
-		}
-
-		if msg.ID != messages.MsgPiece {
-			fmt.Printf("\n[%s] Expected piece message, but got ID %d\n", p.IP.String(), msg.ID)
-			continue
-		}
-
-		fmt.Printf("\n[%s] Received %d bytes for piece %d\n", p.IP.String(), len(msg.Payload), pieceIndex)
-	}
-	return nil
-}
-
-func (p *Peer) choke() {
-	p.choked = true
-	fmt.Printf("[Peer %s] Choked\n", p.IP.String())
-}
-
-func (p *Peer) unchoke() {
-	p.choked = false
-	fmt.Printf("[Peer %s] Unchoked\n", p.IP.String())
-}
-
-func (p *Peer) setBitfield(bf []bool) error {
-	p.Bitfield = append(p.Bitfield, bf...)
-	return nil
-}
-
-// bytesToBoolSlice helper func converts a []byte bitfield to a []bool slice.
-func bytesToBoolSlice(bf []byte) []bool {
-	bools := make([]bool, 0, len(bf)*8)
-	for _, b := range bf {
-		for i := 7; i >= 0; i-- {
-			bools = append(bools, (b>>i)&1 == 1)
-		}
-	}
-	return bools
-}
-
-// COnnect to the associated peer using its IP and Port.
-// Attaches the connection to the `peer` struct which MUST
-// be closed by the caller later in the program.
-func (p *Peer) connect() error {
-	addr := net.JoinHostPort(p.IP.String(), strconv.Itoa(p.Port))
-	c, err := net.DialTimeout("tcp", addr, time.Second*5)
-	if err != nil {
-		return err
-	}
-
-	p.conn = c
-
-	fmt.Println(strings.Repeat("-", 50))
-	fmt.Printf("Connected to peer: %s\n", p.IP.String())
-	fmt.Println(strings.Repeat("-", 50))
-
-	return nil
-}
+package peers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AcidOP/torrly/messages"
+)
+
+type Peer struct {
+	IP       net.IP
+	Port     int
+	ID       []byte // Peer ID, if known before the handshake (e.g. from the tracker)
+	Local    bool   // Found on the local network (BEP 14), dialed before the others
+	choked   bool
+	conn     net.Conn
+	Bitfield []bool
+
+	supportsExtensions bool           // Set from the reserved bits of the handshake
+	supportsDHT        bool           // Set from the reserved bits of the handshake
+	extHandshake       bool           // The peer's extension handshake was received
+	extensions         map[string]int // Extended message IDs advertised by the peer, may be empty
+	metadataSize       int            // Size of the info dictionary, from the extension handshake
+
+	onUpload  func(n int)     // Called with the size of every block sent
+	onDHTPort func(port int)  // Called when the peer tells us its DHT port
+	onPex     func([]Peer)    // Called with the peers added in ut_pex messages, nil to not offer ut_pex
+	onHave    func(index int) // Called with every piece completed with blocks from this peer
+
+	store        Store          // Pieces to download and serve, nil to not transfer any
+	interested   bool           // We told the peer we want some of its pieces
+	peerUnchoked bool           // We let the peer download from us
+	piece        *pieceDownload // Piece being downloaded from the peer
+
+	pexID           int32            // The peer's extended message ID for ut_pex, 0 if it has none
+	pexSent         map[string]*Peer // Peers we told this peer about through ut_pex
+	lastPexReceived time.Time
+}
+
+// Read function reads a `messages.Message` from the peer's connection.
+// (Optionally) accepts a timeout duration to set a read deadline.
+// If no timeout is provided, it defaults to 5 seconds.
+func (p *Peer) Read(timeout ...time.Duration) (*messages.Message, error) {
+	duration := 5 * time.Second // Default timeout
+	if len(timeout) > 0 {
+		duration = timeout[0]
+	}
+
+	p.conn.SetReadDeadline(time.Now().Add(duration))
+	defer p.conn.SetReadDeadline(time.Time{})
+
+	return messages.Receive(p.conn)
+}
+
+// ReadLoop continuously reads messages from the peer until an error occurs.
+// This call blocks until a message is received or an error occurs.
+func (p *Peer) ReadLoop() error {
+	defer p.releasePiece()
+
+	for {
+		msg, err := p.Read(time.Second * 10)
+		if err != nil {
+			p.conn.Close()
+			return err
+		}
+
+		if err := p.handleMessage(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *Peer) handleMessage(msg *messages.Message) error {
+	switch msg.ID {
+	case messages.MsgKeepAlive:
+		fmt.Println("Received keep-alive message from peer:", p.IP.String())
+	case messages.MsgBitfield:
+		p.setBitfield(bytesToBoolSlice(msg.Payload))
+		return p.updateInterest()
+	case messages.MsgChoke:
+		p.choke()
+		p.releasePiece()
+	case messages.MsgUnchoke:
+		p.unchoke()
+		return p.requestBlocks()
+	case messages.MsgInterested:
+		// Everyone who asks may download from us
+		if p.store != nil && !p.peerUnchoked {
+			p.peerUnchoked = true
+			return p.SendUnchoke()
+		}
+	case messages.MsgNotInterested:
+		fmt.Printf("Peer %s is not interested\n", p.IP.String())
+	case messages.MsgHave:
+		if len(msg.Payload) != 4 {
+			return fmt.Errorf("have message of %d bytes from peer %s", len(msg.Payload), p.IP.String())
+		}
+		if err := p.setHave(int(binary.BigEndian.Uint32(msg.Payload))); err != nil {
+			return err
+		}
+		if err := p.updateInterest(); err != nil {
+			return err
+		}
+		return p.requestBlocks()
+	case messages.MsgRequest:
+		return p.handleRequest(msg.Payload)
+	case messages.MsgPiece:
+		return p.handleBlock(msg.Payload)
+	case messages.MsgCancel:
+		// Requests are answered as they arrive, so there is nothing left to cancel
+	case messages.MsgPort:
+		if len(msg.Payload) == 2 && p.onDHTPort != nil {
+			p.onDHTPort(int(binary.BigEndian.Uint16(msg.Payload)))
+		}
+	case messages.MsgExtended:
+		if len(msg.Payload) == 0 {
+			return nil
+		}
+
+		switch msg.Payload[0] {
+		case ExtHandshakeID:
+			return p.handleExtHandshake(msg.Payload[1:])
+		case ExtUtPexID:
+			return p.handlePex(msg.Payload[1:])
+		case ExtUtMetadataID:
+			return p.handleMetadataRequest(msg.Payload[1:])
+		}
+	default:
+		return fmt.Errorf("unknown message ID %d from peer %s", msg.ID, p.IP.String())
+	}
+	return nil
+}
+
+func (p *Peer) choke() {
+	p.choked = true
+	fmt.Printf("[Peer %s] Choked\n", p.IP.String())
+}
+
+func (p *Peer) unchoke() {
+	p.choked = false
+	fmt.Printf("[Peer %s] Unchoked\n", p.IP.String())
+}
+
+func (p *Peer) setBitfield(bf []bool) {
+	p.Bitfield = bf
+}
+
+// bytesToBoolSlice helper func converts a []byte bitfield to a []bool slice.
+func bytesToBoolSlice(bf []byte) []bool {
+	bools := make([]bool, 0, len(bf)*8)
+	for _, b := range bf {
+		for i := 7; i >= 0; i-- {
+			bools = append(bools, (b>>i)&1 == 1)
+		}
+	}
+	return bools
+}
+
+// Addr returns the peer's address as host:port.
+// IPv6 addresses are bracketed and IPv4-mapped ones shown as plain IPv4.
+func (p *Peer) Addr() string {
+	ip := p.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(p.Port))
+}
+
+// COnnect to the associated peer using its IP and Port.
+// Attaches the connection to the `peer` struct which MUST
+// be closed by the caller later in the program.
+func (p *Peer) connect() error {
+	c, err := net.DialTimeout("tcp", p.Addr(), time.Second*5)
+	if err != nil {
+		return err
+	}
+
+	p.conn = c
+
+	fmt.Println(strings.Repeat("-", 50))
+	fmt.Printf("Connected to peer: %s\n", p.Addr())
+	fmt.Println(strings.Repeat("-", 50))
+
+	return nil
+}
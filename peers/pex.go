@@ -0,0 +1,224 @@
+package peers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/AcidOP/torrly/bencode"
+)
+
+// Peer exchange over the extension protocol.
+// https://www.bittorrent.org/beps/bep_0011.html
+const (
+	pexInterval = time.Minute
+
+	// Slack for peers whose once-a-minute timer fires a little early
+	pexMinReceiveInterval = pexInterval - 10*time.Second
+
+	// At most this many peers in each of the added and dropped lists
+	maxPexPeers = 50
+
+	// Don't dial a peer learned through PEX again this soon
+	pexRedialAfter = 10 * time.Minute
+)
+
+// Flags of the peers in the `added` lists.
+const (
+	PexEncryption = 0x01 // Prefers encrypted connections
+	PexSeed       = 0x02 // Upload only
+	PexUTP        = 0x04 // Supports uTP
+	PexHolepunch  = 0x08 // Supports ut_holepunch
+	PexReachable  = 0x10 // Accepts incoming connections
+)
+
+type pexMsg struct {
+	Added    []byte `bencode:"added,omitempty"`    // Compact IPv4 peers
+	AddedF   []byte `bencode:"added.f,omitempty"`  // One flag byte per added IPv4 peer
+	Added6   []byte `bencode:"added6,omitempty"`   // Compact IPv6 peers
+	Added6F  []byte `bencode:"added6.f,omitempty"` // One flag byte per added IPv6 peer
+	Dropped  []byte `bencode:"dropped,omitempty"`
+	Dropped6 []byte `bencode:"dropped6,omitempty"`
+}
+
+// Whether we can send ut_pex messages to the peer.
+func (p *Peer) supportsPex() bool {
+	return atomic.LoadInt32(&p.pexID) != 0
+}
+
+// sendPex tells the peer about the swarm members that joined and left
+// since the last message.
+func (p *Peer) sendPex(added, dropped []*Peer) error {
+	msg := pexMsg{}
+	for _, a := range added {
+		// We only know the listen port of peers we connected to ourselves
+		if a.IP.To4() != nil {
+			msg.Added = appendCompact(msg.Added, a)
+			msg.AddedF = append(msg.AddedF, PexReachable)
+		} else {
+			msg.Added6 = appendCompact(msg.Added6, a)
+			msg.Added6F = append(msg.Added6F, PexReachable)
+		}
+	}
+	for _, d := range dropped {
+		if d.IP.To4() != nil {
+			msg.Dropped = appendCompact(msg.Dropped, d)
+		} else {
+			msg.Dropped6 = appendCompact(msg.Dropped6, d)
+		}
+	}
+
+	payload, err := bencode.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return p.sendExtended(byte(atomic.LoadInt32(&p.pexID)), payload)
+}
+
+// handlePex passes the peers added in a ut_pex message to onPex.
+// Messages sent more often than once a minute are ignored.
+func (p *Peer) handlePex(payload []byte) error {
+	if time.Since(p.lastPexReceived) < pexMinReceiveInterval {
+		return nil
+	}
+	p.lastPexReceived = time.Now()
+
+	msg := pexMsg{}
+	if err := unmarshalLenient(payload, &msg); err != nil {
+		return fmt.Errorf("invalid ut_pex message: %v", err)
+	}
+
+	added, err := parseCompactPeers(msg.Added, net.IPv4len)
+	if err != nil {
+		return err
+	}
+	added6, err := parseCompactPeers(msg.Added6, net.IPv6len)
+	if err != nil {
+		return err
+	}
+
+	added = append(added[:min(len(added), maxPexPeers)], added6[:min(len(added6), maxPexPeers)]...)
+	if len(added) > 0 && p.onPex != nil {
+		p.onPex(added)
+	}
+	return nil
+}
+
+// Append the compact form of a peer: its address followed by a 2 byte port.
+func appendCompact(b []byte, p *Peer) []byte {
+	b = append(b, compactIP(p.IP)...)
+	return binary.BigEndian.AppendUint16(b, uint16(p.Port))
+}
+
+// Parse compact peers with addresses of `ipLen` bytes.
+func parseCompactPeers(compact []byte, ipLen int) ([]Peer, error) {
+	peerLen := ipLen + 2
+	if len(compact)%peerLen != 0 {
+		return nil, fmt.Errorf("malformed compact peers: %d bytes", len(compact))
+	}
+
+	pArr := make([]Peer, 0, len(compact)/peerLen)
+	for i := 0; i < len(compact); i += peerLen {
+		pArr = append(pArr, Peer{
+			IP:   net.IP(append([]byte(nil), compact[i:i+ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(compact[i+ipLen : i+peerLen])),
+		})
+	}
+	return pArr, nil
+}
+
+// Every minute, tell each peer supporting ut_pex which peers we connected
+// to and lost since the last message. The first message lists them all.
+func (pm *PeerManager) pexLoop() {
+	defer pm.wg.Done()
+
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pm.closed:
+			return
+		case <-ticker.C:
+		}
+
+		pm.mu.Lock()
+		connected := append([]*Peer(nil), pm.connectedPeers...)
+		pm.mu.Unlock()
+
+		for _, p := range connected {
+			if !p.supportsPex() {
+				continue
+			}
+
+			added, dropped := p.pexDiff(connected)
+			if len(added) == 0 && len(dropped) == 0 {
+				continue
+			}
+
+			if err := p.sendPex(added, dropped); err != nil {
+				fmt.Printf("Error sending ut_pex to peer %s: %v\n", p.Addr(), err)
+			}
+		}
+	}
+}
+
+// The peers to add and drop in the next ut_pex message to p, at most
+// maxPexPeers each. Peers that don't fit are left for the next message.
+func (p *Peer) pexDiff(connected []*Peer) (added, dropped []*Peer) {
+	if p.pexSent == nil {
+		p.pexSent = map[string]*Peer{}
+	}
+
+	current := map[string]bool{}
+	for _, c := range connected {
+		if c == p {
+			continue
+		}
+		current[c.Addr()] = true
+
+		if _, ok := p.pexSent[c.Addr()]; !ok && len(added) < maxPexPeers {
+			p.pexSent[c.Addr()] = c
+			added = append(added, c)
+		}
+	}
+
+	for addr, s := range p.pexSent {
+		if !current[addr] && len(dropped) < maxPexPeers {
+			delete(p.pexSent, addr)
+			dropped = append(dropped, s)
+		}
+	}
+	return added, dropped
+}
+
+// Dial the peers learned through PEX we haven't recently tried.
+func (pm *PeerManager) connectPexPeers(pArr []Peer) {
+	pm.mu.Lock()
+	if pm.pexDialed == nil {
+		pm.pexDialed = map[string]time.Time{}
+	}
+
+	for addr, at := range pm.pexDialed {
+		if time.Since(at) >= pexRedialAfter {
+			delete(pm.pexDialed, addr)
+		}
+	}
+
+	fresh := []Peer{}
+	for _, p := range pArr {
+		if p.IP == nil || p.Port <= 0 || time.Since(pm.pexDialed[p.Addr()]) < pexRedialAfter {
+			continue
+		}
+		pm.pexDialed[p.Addr()] = time.Now()
+		fresh = append(fresh, p)
+	}
+	pm.mu.Unlock()
+
+	if len(fresh) > 0 {
+		fmt.Printf("Learned %d new peers through PEX\n", len(fresh))
+		go pm.Connect(fresh)
+	}
+}
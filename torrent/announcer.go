@@ -0,0 +1,323 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AcidOP/torrly/peers"
+)
+
+const (
+	defaultAnnounceInterval = 30 * time.Minute // Used when the tracker doesn't send an interval
+	announceRetryDelay      = time.Minute      // Wait before retrying when no tracker says otherwise
+	minPeerRequestInterval  = time.Minute      // Lower bound for on-demand announces without `min interval`
+	minConnectedPeers       = 10               // Ask the trackers for more peers below this many connections
+)
+
+// transferStats are the byte counters reported to trackers.
+type transferStats struct {
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+	verified   atomic.Int64 // Bytes of pieces that passed the hash check
+
+	mu        sync.Mutex
+	pieces    map[int]bool  // Indices of the verified pieces
+	completed chan struct{} // Closed once every wanted piece is verified
+}
+
+// Number of bytes uploaded to peers so far.
+func (t *Torrent) Uploaded() int64 {
+	return t.stats.uploaded.Load()
+}
+
+// Number of bytes downloaded from peers so far that passed the hash check.
+func (t *Torrent) Downloaded() int64 {
+	return t.stats.downloaded.Load()
+}
+
+// Number of bytes still needed to complete the torrent.
+// The size of a magnet link is unknown until its metadata arrives, in which
+// case one byte is reported so trackers don't count us as a seeder.
+func (t *Torrent) Left() int64 {
+	if t.MissingMetadata {
+		return 1
+	}
+	return max(int64(t.Length)-t.stats.verified.Load(), 0)
+}
+
+// Record n bytes of verified data received from peers.
+func (t *Torrent) AddDownloaded(n int) {
+	t.stats.downloaded.Add(int64(n))
+}
+
+// Record n bytes sent to a peer.
+func (t *Torrent) AddUploaded(n int) {
+	t.stats.uploaded.Add(int64(n))
+}
+
+// Record that a piece passed its hash check.
+// Pieces verified more than once are only counted the first time.
+func (t *Torrent) PieceVerified(index int) {
+	begin := index * t.PieceLength
+	if index < 0 || begin >= t.Length {
+		return
+	}
+
+	s := &t.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pieces == nil {
+		s.pieces = map[int]bool{}
+	}
+	if s.pieces[index] {
+		return
+	}
+	s.pieces[index] = true
+
+	if s.verified.Add(int64(min(t.PieceLength, t.Length-begin))) >= int64(t.Length) {
+		t.closeCompleted()
+	}
+}
+
+// Record that every wanted piece is verified, which is all of them unless
+// only some files were selected.
+func (t *Torrent) markCompleted() {
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+	t.closeCompleted()
+}
+
+// Close the completed channel unless it already is. Caller must hold stats.mu.
+func (t *Torrent) closeCompleted() {
+	ch := t.completedChan()
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
+
+// Channel closed once the whole torrent is verified. Caller must hold stats.mu.
+func (t *Torrent) completedChan() chan struct{} {
+	if t.stats.completed == nil {
+		t.stats.completed = make(chan struct{})
+	}
+	return t.stats.completed
+}
+
+// Completed returns a channel that is closed once every piece is verified,
+// or every piece of the selected files.
+func (t *Torrent) Completed() <-chan struct{} {
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+	return t.completedChan()
+}
+
+// announcer keeps a swarm's trackers up to date for as long as we are in it.
+// It sends `started` when joining, re-announces on the tracker's interval,
+// sends `completed` once when the download finishes and `stopped` on shutdown.
+// It is the PeerSource of the torrent's HTTP and UDP trackers; a single one
+// covers every tier, since BEP 12 falls back across trackers of any protocol.
+// https://wiki.theory.org/BitTorrentSpecification#Tracker_Request_Parameters
+type announcer struct {
+	t        *Torrent
+	infoHash hash
+	peers    chan []peers.Peer // Peers of every successful announce
+
+	mu          sync.Mutex
+	pending     string // Event to send with the next announce
+	started     bool   // Whether a tracker acknowledged `started`
+	interval    time.Duration
+	minInterval time.Duration
+	last        time.Time // Time of the last successful announce
+	next        time.Time // Time of the next scheduled announce
+
+	once sync.Once // Starts the announce loop, or marks it as never started
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (t *Torrent) newAnnouncer(infoHash hash) *announcer {
+	return &announcer{
+		t:        t,
+		infoHash: infoHash,
+		peers:    make(chan []peers.Peer, 1),
+		pending:  eventStarted,
+		interval: defaultAnnounceInterval,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Announce sends `started` and starts the announce loop on the first call.
+// Later calls ask the trackers for more peers as soon as `min interval` allows.
+func (a *announcer) Announce() error {
+	first := false
+	a.once.Do(func() { first = true })
+	if !first {
+		a.requestPeers()
+		return nil
+	}
+
+	// A torrent that is already complete when joining never sends `completed`
+	seeding := false
+	select {
+	case <-a.t.Completed():
+		seeding = true
+	default:
+	}
+
+	pArr, err := a.announce()
+	a.deliver(pArr)
+
+	go a.run(seeding)
+	return err
+}
+
+func (a *announcer) Peers() <-chan []peers.Peer {
+	return a.peers
+}
+
+// Stop the announce loop and wait for the `stopped` event to be sent.
+func (a *announcer) Stop() {
+	// Nothing to tell the trackers if we never announced
+	a.once.Do(func() { close(a.done) })
+
+	close(a.stop)
+	<-a.done
+	close(a.peers)
+}
+
+// Hand peers to whoever reads Peers, unless we are stopping.
+func (a *announcer) deliver(pArr []peers.Peer) {
+	if len(pArr) == 0 {
+		return
+	}
+
+	select {
+	case a.peers <- pArr:
+	case <-a.stop:
+	}
+}
+
+// Announce with the pending event and schedule the next announce.
+// Returns the peers handed out by the tracker.
+func (a *announcer) announce() ([]peers.Peer, error) {
+	a.mu.Lock()
+	event := a.pending
+	a.mu.Unlock()
+
+	tr, err := a.t.announceSwarm(a.infoHash, event)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err != nil {
+		// Retry as soon as one of the failing trackers may be tried again
+		a.next = a.t.nextTrackerRetry()
+		if a.next.IsZero() {
+			a.next = time.Now().Add(announceRetryDelay)
+		}
+		return nil, err
+	}
+
+	if tr.Interval > 0 {
+		a.interval = time.Duration(tr.Interval) * time.Second
+	}
+	if tr.MinInterval > 0 {
+		a.minInterval = time.Duration(tr.MinInterval) * time.Second
+	}
+
+	if event == eventStarted {
+		a.started = true
+	}
+	if a.pending == event {
+		a.pending = eventNone
+	}
+
+	a.last = time.Now()
+	a.next = a.last.Add(a.interval)
+	return tr.peers(), nil
+}
+
+// Run the announce loop until Stop is called.
+// The initial `started` announce is expected to have been made already.
+func (a *announcer) run(seeding bool) {
+	defer close(a.done)
+
+	completed := a.t.Completed()
+	if seeding {
+		completed = nil
+	}
+
+	for {
+		a.mu.Lock()
+		timer := time.NewTimer(time.Until(a.next))
+		a.mu.Unlock()
+
+		select {
+		case <-a.stop:
+			timer.Stop()
+			a.sendStopped()
+			return
+
+		case <-completed:
+			completed = nil
+			a.mu.Lock()
+			if a.started {
+				a.pending = eventCompleted
+				a.next = time.Now()
+			}
+			a.mu.Unlock()
+
+		case <-a.wake:
+			// Ask for peers early, but never more often than the tracker allows
+			a.mu.Lock()
+			wait := a.minInterval
+			if wait == 0 {
+				wait = minPeerRequestInterval
+			}
+			if earliest := a.last.Add(wait); earliest.Before(a.next) {
+				a.next = earliest
+			}
+			a.mu.Unlock()
+
+		case <-timer.C:
+			pArr, err := a.announce()
+			if err != nil {
+				fmt.Println("Announce failed:", err)
+				continue
+			}
+			a.deliver(pArr)
+		}
+		timer.Stop()
+	}
+}
+
+// Tell the trackers we are leaving, if they ever knew we joined.
+func (a *announcer) sendStopped() {
+	a.mu.Lock()
+	if !a.started {
+		a.mu.Unlock()
+		return
+	}
+	a.pending = eventStopped
+	a.mu.Unlock()
+
+	if _, err := a.announce(); err != nil {
+		fmt.Println("Failed to send stopped event:", err)
+	}
+}
+
+// Ask the trackers for more peers as soon as `min interval` allows.
+func (a *announcer) requestPeers() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,105 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAnnouncerReportsTransfer(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		announces []url.Values
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		announces = append(announces, r.URL.Query())
+		mu.Unlock()
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer srv.Close()
+
+	path, seedDir := testTorrent(t)
+
+	seeder := loadTestTorrent(t, path)
+	seed, err := seeder.newDownloader(seedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor := loadTestTorrent(t, path)
+	tor.AnnounceList = [][]string{{srv.URL}}
+	leech, err := tor.newDownloader(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := tor.newAnnouncer(tor.InfoHash)
+	if err := a.Announce(); err != nil {
+		t.Fatal(err)
+	}
+
+	left := tor.Left()
+	for {
+		index, length, ok := leech.Pick(seed.Bitfield())
+		if !ok {
+			break
+		}
+		data, err := seed.ReadBlock(index, 0, length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !leech.Complete(index, data) {
+			t.Fatalf("piece %d rejected", index)
+		}
+
+		if tor.Left() >= left {
+			t.Fatalf("left went from %d to %d after piece %d", left, tor.Left(), index)
+		}
+		left = tor.Left()
+	}
+	tor.AddUploaded(1000)
+
+	// Wait for `completed` to go out before stopping
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(announces)
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("completed was never announced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	events := []string{}
+	for _, q := range announces {
+		events = append(events, q.Get("event"))
+	}
+	if len(events) != 3 || events[0] != eventStarted || events[1] != eventCompleted || events[2] != eventStopped {
+		t.Fatalf("events = %q, want [started completed stopped]", events)
+	}
+
+	stopped := announces[2]
+	want := map[string]string{
+		"uploaded":   "1000",
+		"downloaded": strconv.Itoa(tor.Length),
+		"left":       "0",
+	}
+	for key, value := range want {
+		if got := stopped.Get(key); got != value {
+			t.Errorf("stopped announce has %s=%s, want %s", key, got, value)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package torrent
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// File attributes and padding files.
+// https://www.bittorrent.org/beps/bep_0047.html
+
+// Padding files only exist to align the next file to a piece boundary.
+// Their content is all zeros and they are never written to disk.
+func (f File) IsPadding() bool {
+	return strings.ContainsRune(f.Attr, 'p')
+}
+
+func (f File) IsExecutable() bool {
+	return strings.ContainsRune(f.Attr, 'x')
+}
+
+func (f File) IsHidden() bool {
+	return strings.ContainsRune(f.Attr, 'h')
+}
+
+func (f File) IsSymlink() bool {
+	return strings.ContainsRune(f.Attr, 'l')
+}
+
+// Set the symlink target from its path components.
+// Only files with the `l` attribute may have one.
+func (f *File) setSymlinkPath(components []string) error {
+	if !f.IsSymlink() {
+		return nil
+	}
+
+	if len(components) == 0 {
+		return fmt.Errorf("symlink %q has no symlink path", f.Path)
+	}
+
+	for _, c := range components {
+		if !validPathComponent(c) {
+			return fmt.Errorf("symlink %q has an invalid target component: %q", f.Path, c)
+		}
+	}
+
+	f.SymlinkPath = filepath.Join(components...)
+	return nil
+}
+
+// Whether a path component is safe to join to a download directory.
+func validPathComponent(c string) bool {
+	return c != "" && c != "." && c != ".." && !strings.ContainsAny(c, "/\\")
+}
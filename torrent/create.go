@@ -0,0 +1,297 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AcidOP/torrly/bencode"
+)
+
+// Options for creating a .torrent file with `Create`.
+// Zero values are left out of the metainfo.
+type CreateOptions struct {
+	PieceLength  int        // Bytes per piece, 0 picks one from the total size
+	Name         string     // Name of the torrent, defaults to the base name of the path
+	Announce     string     // Primary tracker URL
+	AnnounceList [][]string // Tiers of tracker URLs (BEP 12)
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // Zero omits the key, keeping the output reproducible
+	Private      bool      // Sets `private=1` (BEP 27)
+	Source       string    // Source tag, commonly required by private trackers
+	URLList      []string  // Web seed URLs (BEP 19)
+}
+
+const (
+	minAutoPieceLength = 16 * 1024
+	maxAutoPieceLength = 16 * 1024 * 1024
+	targetPieceCount   = 1500
+)
+
+// A file to be included in a new torrent.
+type createFile struct {
+	path       string   // Path on disk
+	components []string // Path components relative to the torrent root
+	length     int
+	offset     int
+}
+
+// Create builds a .torrent file for the file or directory at `root`.
+// Files are added in lexical order and pieces are hashed in parallel.
+// The output is byte-for-byte identical for the same inputs and options.
+func Create(root string, opts CreateOptions) ([]byte, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := collectFiles(root, stat.IsDir())
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0
+	for _, f := range files {
+		total += f.length
+	}
+	if total == 0 {
+		return nil, errors.New("cannot create torrent: no data to hash")
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = autoPieceLength(total)
+	}
+	if pieceLength < 0 {
+		return nil, fmt.Errorf("invalid piece length: %d", pieceLength)
+	}
+
+	pieces, err := hashPieces(files, total, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	name := opts.Name
+	if name == "" {
+		// Resolve the path first, or a root of "." would name the torrent "."
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		name = filepath.Base(abs)
+	}
+	if name == string(filepath.Separator) {
+		return nil, errors.New("cannot name a torrent after the filesystem root, set a name")
+	}
+
+	info := bcodeInfo{
+		Name:        name,
+		Pieces:      string(pieces),
+		PieceLength: pieceLength,
+		Source:      opts.Source,
+	}
+
+	if opts.Private {
+		info.Private = 1
+	}
+
+	if stat.IsDir() {
+		for _, f := range files {
+			info.Files = append(info.Files, bcodeFile{Length: f.length, Path: f.components})
+		}
+	} else {
+		info.Length = total
+	}
+
+	rawInfo, err := bencode.Marshal(info)
+	if err != nil {
+		return nil, errors.New("failed to encode info dictionary: " + err.Error())
+	}
+
+	bt := bcodeTorrent{
+		Announce:     opts.Announce,
+		AnnounceList: opts.AnnounceList,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		Info:         rawInfo,
+		URLList:      opts.URLList,
+	}
+
+	if !opts.CreationDate.IsZero() {
+		bt.CreationDate = opts.CreationDate.Unix()
+	}
+
+	data, err := bencode.Marshal(bt)
+	if err != nil {
+		return nil, errors.New("failed to encode torrent: " + err.Error())
+	}
+	return data, nil
+}
+
+// Pick a power of two piece length giving roughly `targetPieceCount` pieces.
+func autoPieceLength(total int) int {
+	pieceLength := minAutoPieceLength
+	for pieceLength < maxAutoPieceLength && total/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// Collect the regular files under `root` in lexical order.
+// A single file is returned as is, with its base name as the only component.
+func collectFiles(root string, isDir bool) ([]createFile, error) {
+	if !isDir {
+		stat, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		return []createFile{{
+			path:       root,
+			components: []string{filepath.Base(root)},
+			length:     int(stat.Size()),
+		}}, nil
+	}
+
+	files := []createFile{}
+	offset := 0
+
+	// WalkDir visits entries in lexical order, which makes the output deterministic
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, createFile{
+			path:       path,
+			components: strings.Split(filepath.ToSlash(rel), "/"),
+			length:     int(stat.Size()),
+			offset:     offset,
+		})
+		offset += int(stat.Size())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("directory %s contains no files", root)
+	}
+	return files, nil
+}
+
+// Hash every piece of the concatenated files using one worker per CPU.
+// Returns the concatenated SHA1 hashes in piece order.
+func hashPieces(files []createFile, total, pieceLength int) ([]byte, error) {
+	numPieces := (total + pieceLength - 1) / pieceLength
+	hashes := make([]byte, numPieces*sha1.Size)
+
+	indices := make(chan int)
+	errs := make(chan error, 1)
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, pieceLength)
+			for idx := range indices {
+				begin := idx * pieceLength
+				length := min(pieceLength, total-begin)
+
+				if err := readAcrossFiles(files, begin, buf[:length]); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					continue
+				}
+
+				h := sha1.Sum(buf[:length])
+				copy(hashes[idx*sha1.Size:], h[:])
+			}
+		}()
+	}
+
+	for idx := 0; idx < numPieces; idx++ {
+		indices <- idx
+	}
+	close(indices)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+		return hashes, nil
+	}
+}
+
+// Fill `buf` with the torrent data starting at byte `offset`,
+// reading from as many consecutive files as needed.
+func readAcrossFiles(files []createFile, offset int, buf []byte) error {
+	for _, f := range files {
+		if len(buf) == 0 {
+			break
+		}
+
+		if offset >= f.offset+f.length || f.length == 0 {
+			continue
+		}
+
+		n := min(len(buf), f.offset+f.length-offset)
+		if err := readFileAt(f.path, offset-f.offset, buf[:n]); err != nil {
+			return err
+		}
+
+		buf = buf[n:]
+		offset += n
+	}
+
+	if len(buf) != 0 {
+		return errors.New("files changed while creating torrent")
+	}
+	return nil
+}
+
+func readFileAt(path string, offset int, buf []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// ReadAt may return io.EOF along with a full buffer at the end of the file
+	n, err := f.ReadAt(buf, int64(offset))
+	if n < len(buf) {
+		if err == nil || err == io.EOF {
+			return fmt.Errorf("file %s changed while creating torrent", path)
+		}
+		return err
+	}
+	return nil
+}
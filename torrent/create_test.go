@@ -0,0 +1,42 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateNamesRelativeRoot(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "album")
+	if err := os.MkdirAll(filepath.Join(dir, "disc1"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "disc1", "track.flac"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(filepath.Join(dir, "disc1"))
+
+	for _, root := range []string{".", "./", ".."} {
+		data, err := Create(root, CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(t.TempDir(), "out.torrent")
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		tor, err := NewTorrentFromFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := "disc1"
+		if root == ".." {
+			want = "album"
+		}
+		if tor.Name != want {
+			t.Errorf("Create(%q) named the torrent %q, want %q", root, tor.Name, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AcidOP/torrly/peers"
+)
+
+// Interval between DHT announces of a swarm, as for a tracker.
+const dhtAnnounceInterval = 15 * time.Minute
+
+// Parse the `nodes` key of a torrent file: a list of [host, port] pairs.
+func parseNodes(raw []any) []string {
+	nodes := []string{}
+	for _, n := range raw {
+		pair, ok := n.([]any)
+		if !ok || len(pair) != 2 {
+			continue
+		}
+
+		host, ok := pair[0].(string)
+		port, ok2 := pair[1].(int64)
+		if !ok || !ok2 || port <= 0 || port > 65535 {
+			continue
+		}
+		nodes = append(nodes, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+	return nodes
+}
+
+// Join the DHT through the torrent's own nodes if we don't know any yet.
+func (t *Torrent) bootstrapDHT() {
+	if t.DHT.Len() > 0 {
+		for _, n := range t.Nodes {
+			t.DHT.AddNode(n)
+		}
+		return
+	}
+
+	if err := t.DHT.Bootstrap(t.Nodes...); err != nil {
+		fmt.Println("DHT bootstrap failed:", err)
+	}
+}
+
+// Advertise our DHT node to peers and learn the nodes of theirs.
+func (t *Torrent) useDHT(pm *peers.PeerManager) {
+	if t.DHT == nil || !t.DHTAllowed() {
+		return
+	}
+
+	pm.DHTPort = t.DHT.Addr().Port
+	pm.OnDHTNode = t.DHT.AddNode
+}
+
+func tcpPeers(addrs []*net.TCPAddr) []peers.Peer {
+	pArr := []peers.Peer{}
+	for _, addr := range addrs {
+		pArr = append(pArr, peers.Peer{IP: addr.IP, Port: addr.Port})
+	}
+	return pArr
+}
+
+// dhtSource finds the peers of a swarm on the DHT and announces us there.
+type dhtSource struct {
+	t        *Torrent
+	infoHash hash
+	peers    chan []peers.Peer
+
+	once sync.Once
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (t *Torrent) newDHTSource(infoHash hash) *dhtSource {
+	return &dhtSource{
+		t:        t,
+		infoHash: infoHash,
+		peers:    make(chan []peers.Peer, 1),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Announce starts the announce loop on the first call, later calls
+// look for peers again right away.
+func (s *dhtSource) Announce() error {
+	first := false
+	s.once.Do(func() { first = true })
+	if first {
+		go s.run()
+		return nil
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *dhtSource) Peers() <-chan []peers.Peer {
+	return s.peers
+}
+
+func (s *dhtSource) Stop() {
+	s.once.Do(func() { close(s.done) })
+
+	close(s.stop)
+	<-s.done
+	close(s.peers)
+}
+
+func (s *dhtSource) run() {
+	defer close(s.done)
+
+	s.t.bootstrapDHT()
+
+	for {
+		addrs, err := s.t.DHT.Announce(s.infoHash, s.t.Port)
+		if err != nil {
+			fmt.Println("DHT announce failed:", err)
+		}
+
+		if pArr := tcpPeers(addrs); len(pArr) > 0 {
+			select {
+			case s.peers <- pArr:
+			case <-s.stop:
+				return
+			}
+		}
+
+		timer := time.NewTimer(dhtAnnounceInterval)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
@@ -0,0 +1,185 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AcidOP/torrly/peers"
+)
+
+// Peers found again within this long are not handed out a second time.
+const candidateTTL = 10 * time.Minute
+
+// PeerSource is a way of finding peers for a swarm: its trackers, a list of
+// known peers, the DHT or peer exchange.
+type PeerSource interface {
+	// Announce starts looking for peers on the first call, and asks for
+	// more peers right away on later calls.
+	Announce() error
+	// Peers delivers the peers found, in batches, until Stop returns.
+	Peers() <-chan []peers.Peer
+	// Stop stops looking for peers and closes the Peers channel.
+	Stop()
+}
+
+// staticSource hands out a fixed list of peers, e.g. the `x.pe` peers of a
+// magnet link.
+type staticSource struct {
+	list  []peers.Peer
+	peers chan []peers.Peer
+
+	mu     sync.Mutex // Guards sends on peers against Stop closing it
+	closed bool
+}
+
+func NewStaticSource(list []peers.Peer) PeerSource {
+	return &staticSource{
+		list:  list,
+		peers: make(chan []peers.Peer, 1),
+	}
+}
+
+// Announce offers the whole list again, if it hasn't been picked up yet.
+func (s *staticSource) Announce() error {
+	if len(s.list) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	select {
+	case s.peers <- s.list:
+	default:
+	}
+	return nil
+}
+
+func (s *staticSource) Peers() <-chan []peers.Peer {
+	return s.peers
+}
+
+func (s *staticSource) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.peers)
+	}
+}
+
+// Discovery runs the peer sources of a swarm side by side and passes the
+// peers they find on, dropping the ones already handed out recently.
+type Discovery struct {
+	onPeers func([]peers.Peer) // Called with every batch of new peers
+
+	mu      sync.Mutex
+	sources []PeerSource
+	seen    map[string]time.Time // When each address was last handed out
+	started bool
+	wg      sync.WaitGroup // Running forwarders
+}
+
+func NewDiscovery(onPeers func([]peers.Peer)) *Discovery {
+	return &Discovery{
+		onPeers: onPeers,
+		seen:    map[string]time.Time{},
+	}
+}
+
+// Add a peer source. Sources added after Start are started right away.
+func (d *Discovery) Add(src PeerSource) {
+	d.mu.Lock()
+	d.sources = append(d.sources, src)
+	started := d.started
+	d.mu.Unlock()
+
+	d.wg.Add(1)
+	go d.forward(src)
+
+	if started {
+		go d.announce(src)
+	}
+}
+
+// Number of peer sources.
+func (d *Discovery) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.sources)
+}
+
+// Start every source.
+func (d *Discovery) Start() {
+	d.mu.Lock()
+	d.started = true
+	sources := d.sources
+	d.mu.Unlock()
+
+	for _, src := range sources {
+		go d.announce(src)
+	}
+}
+
+// RequestPeers asks every source for more peers.
+func (d *Discovery) RequestPeers() {
+	d.Start()
+}
+
+// Stop every source and wait for them to finish.
+func (d *Discovery) Stop() {
+	d.mu.Lock()
+	sources := d.sources
+	d.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src PeerSource) {
+			defer wg.Done()
+			src.Stop()
+		}(src)
+	}
+	wg.Wait()
+	d.wg.Wait()
+}
+
+func (d *Discovery) announce(src PeerSource) {
+	if err := src.Announce(); err != nil {
+		fmt.Println("Peer discovery:", err)
+	}
+}
+
+// Pass on the peers of a source until its channel is closed.
+func (d *Discovery) forward(src PeerSource) {
+	defer d.wg.Done()
+
+	for pArr := range src.Peers() {
+		if fresh := d.filter(pArr); len(fresh) > 0 {
+			d.onPeers(fresh)
+		}
+	}
+}
+
+// Keep the peers whose address wasn't handed out recently.
+func (d *Discovery) filter(pArr []peers.Peer) []peers.Peer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	fresh := []peers.Peer{}
+	for _, p := range pArr {
+		addr := p.Addr()
+		if last, ok := d.seen[addr]; ok && now.Sub(last) < candidateTTL {
+			continue
+		}
+		d.seen[addr] = now
+		fresh = append(fresh, p)
+	}
+	return fresh
+}
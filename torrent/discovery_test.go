@@ -0,0 +1,43 @@
+package torrent
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/AcidOP/torrly/peers"
+)
+
+func TestDiscoveryDropsRecentPeers(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		found []peers.Peer
+	)
+	d := NewDiscovery(func(pArr []peers.Peer) {
+		mu.Lock()
+		defer mu.Unlock()
+		found = append(found, pArr...)
+	})
+
+	list := []peers.Peer{
+		{IP: net.IPv4(10, 0, 0, 1), Port: 6881},
+		{IP: net.IPv4(10, 0, 0, 2), Port: 6881},
+	}
+	src := NewStaticSource(list)
+	d.Add(src)
+
+	// The second offer is either dropped or filtered out
+	src.Announce()
+	src.Announce()
+	d.Stop()
+
+	if len(found) != len(list) {
+		t.Errorf("found %d peers, want %d", len(found), len(list))
+	}
+
+	// Late announces find the source closed
+	if err := src.Announce(); err != nil {
+		t.Error(err)
+	}
+	src.Stop()
+}
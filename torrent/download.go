@@ -0,0 +1,175 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// downloader hands out the pieces of a torrent to its peers, checks the
+// ones they send back and writes them to storage. A single one serves every
+// swarm of the torrent: hybrid torrents have the same pieces in both.
+// It is the peers.Store of the torrent's peer managers.
+type downloader struct {
+	t       *Torrent
+	storage *Storage
+
+	mu     sync.Mutex
+	have   []bool // Pieces written to storage
+	picked []bool // Pieces being downloaded from some peer
+	wanted []bool // Pieces overlapping the selected files
+	left   int    // Wanted pieces not written yet, the download is done at 0
+	once   sync.Once
+}
+
+// Create the storage in `dir` and check which pieces are already there,
+// so an interrupted download picks up where it left off.
+func (t *Torrent) newDownloader(dir string) (*downloader, error) {
+	storage, err := t.NewStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(t.PieceHashes)
+	d := &downloader{
+		t:       t,
+		storage: storage,
+		have:    make([]bool, n),
+		picked:  make([]bool, n),
+		wanted:  t.wantedPieces(),
+	}
+
+	for i, expected := range t.PieceHashes {
+		if ok, err := storage.VerifyPiece(i, expected); err == nil && ok {
+			d.have[i] = true
+			t.PieceVerified(i)
+		}
+		if d.wanted[i] && !d.have[i] {
+			d.left++
+		}
+	}
+
+	if d.left == 0 {
+		d.finish()
+	} else if t.Left() < int64(t.Length) {
+		fmt.Printf("Resuming download, %d of %d bytes already on disk\n", int64(t.Length)-t.Left(), t.Length)
+	}
+	return d, nil
+}
+
+// Pieces overlapping the files of SelectedFiles, every piece if none are selected.
+func (t *Torrent) wantedPieces() []bool {
+	wanted := make([]bool, t.numPieces())
+	if len(t.SelectedFiles) == 0 {
+		for i := range wanted {
+			wanted[i] = true
+		}
+		return wanted
+	}
+
+	for _, idx := range t.SelectedFiles {
+		if idx < 0 || idx >= len(t.Files) || t.Files[idx].Length == 0 {
+			continue
+		}
+		f := t.Files[idx]
+		for i := f.Offset / t.PieceLength; i <= (f.Offset+f.Length-1)/t.PieceLength; i++ {
+			wanted[i] = true
+		}
+	}
+	return wanted
+}
+
+func (d *downloader) Bitfield() []bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.have)
+}
+
+// Pick the first piece we still need that the peer has and nobody
+// else is downloading.
+func (d *downloader) Pick(has []bool) (int, int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, ok := range has {
+		if !ok || i >= len(d.have) || d.have[i] || d.picked[i] || !d.wanted[i] {
+			continue
+		}
+
+		d.picked[i] = true
+		begin := i * d.t.PieceLength
+		return i, min(d.t.PieceLength, d.t.Length-begin), true
+	}
+	return 0, 0, false
+}
+
+func (d *downloader) Release(index int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if index >= 0 && index < len(d.picked) {
+		d.picked[index] = false
+	}
+}
+
+// Check a downloaded piece against its hash and write it to storage.
+func (d *downloader) Complete(index int, data []byte) bool {
+	defer d.Release(index)
+
+	if index < 0 || index >= len(d.t.PieceHashes) {
+		return false
+	}
+
+	h := sha1.Sum(data)
+	if !bytes.Equal(h[:], d.t.PieceHashes[index][:]) {
+		return false
+	}
+
+	if err := d.storage.WritePiece(index, data); err != nil {
+		fmt.Printf("Error writing piece %d: %v\n", index, err)
+		return false
+	}
+
+	d.mu.Lock()
+	if !d.have[index] && d.wanted[index] {
+		d.left--
+	}
+	d.have[index] = true
+	done := d.left == 0
+	d.mu.Unlock()
+
+	d.t.AddDownloaded(len(data))
+	d.t.PieceVerified(index)
+	if done {
+		d.finish()
+	}
+	return true
+}
+
+// Only pieces we have are served.
+func (d *downloader) ReadBlock(index, begin, length int) ([]byte, error) {
+	d.mu.Lock()
+	ok := index >= 0 && index < len(d.have) && d.have[index]
+	d.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("we don't have piece %d", index)
+	}
+	return d.storage.ReadBlock(index, begin, length)
+}
+
+// Apply the file attributes once every wanted piece is on disk,
+// and let the announcers know the download is complete.
+func (d *downloader) finish() {
+	d.once.Do(func() {
+		d.t.markCompleted()
+
+		if err := d.storage.Finalize(d.t.SelectedFiles); err != nil {
+			fmt.Println("Error finalizing download:", err)
+			return
+		}
+		fmt.Println("Download complete:", d.t.Name)
+	})
+}
@@ -0,0 +1,219 @@
+package torrent
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Create a multi-file torrent of random data in a temporary directory.
+// Returns the path of the .torrent file and the directory holding the data.
+func testTorrent(t *testing.T) (string, string) {
+	t.Helper()
+
+	parent := t.TempDir()
+	root := filepath.Join(parent, "data")
+
+	rng := rand.New(rand.NewSource(1))
+	for name, size := range map[string]int{"a.bin": 40000, "sub/b.bin": 10000} {
+		data := make([]byte, size)
+		rng.Read(data)
+
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := Create(root, CreateOptions{PieceLength: 16 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "data.torrent")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, parent
+}
+
+func loadTestTorrent(t *testing.T, path string) *Torrent {
+	t.Helper()
+
+	tor, err := NewTorrentFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tor
+}
+
+func TestDownloaderTransfer(t *testing.T) {
+	path, seedDir := testTorrent(t)
+
+	seeder := loadTestTorrent(t, path)
+	seed, err := seeder.newDownloader(seedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seeder.Left() != 0 {
+		t.Fatalf("seeder has %d bytes left, want 0", seeder.Left())
+	}
+
+	leecher := loadTestTorrent(t, path)
+	leecher.Files[0].Attr = "x"
+
+	leechDir := t.TempDir()
+	leech, err := leecher.newDownloader(leechDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leecher.Left() != int64(leecher.Length) {
+		t.Fatalf("empty download has %d bytes left, want %d", leecher.Left(), leecher.Length)
+	}
+
+	for {
+		index, length, ok := leech.Pick(seed.Bitfield())
+		if !ok {
+			break
+		}
+
+		data := []byte{}
+		for begin := 0; begin < length; begin += 1000 {
+			block, err := seed.ReadBlock(index, begin, min(1000, length-begin))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, block...)
+		}
+
+		// A corrupt piece is rejected and handed out again
+		corrupt := bytes.Clone(data)
+		corrupt[0] ^= 0xff
+		if leech.Complete(index, corrupt) {
+			t.Fatalf("corrupt piece %d accepted", index)
+		}
+		if again, _, _ := leech.Pick(seed.Bitfield()); again != index {
+			t.Fatalf("picked piece %d after piece %d failed, want it again", again, index)
+		}
+
+		if !leech.Complete(index, data) {
+			t.Fatalf("piece %d rejected", index)
+		}
+	}
+
+	select {
+	case <-leecher.Completed():
+	default:
+		t.Fatalf("download not completed, %d bytes left", leecher.Left())
+	}
+
+	for _, name := range []string{"a.bin", "sub/b.bin"} {
+		want, _ := os.ReadFile(filepath.Join(seedDir, "data", name))
+		got, err := os.ReadFile(filepath.Join(leechDir, "data", name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("downloaded %s differs from the original (%v)", name, err)
+		}
+	}
+
+	// Finalize ran once every piece was written
+	stat, err := os.Stat(filepath.Join(leechDir, "data", "a.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode()&0o100 == 0 {
+		t.Errorf("executable file has mode %v", stat.Mode())
+	}
+
+	// A restarted download finds everything on disk
+	resumed := loadTestTorrent(t, path)
+	if _, err := resumed.newDownloader(leechDir); err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Left() != 0 {
+		t.Errorf("resumed download has %d bytes left, want 0", resumed.Left())
+	}
+}
+
+func TestDownloaderSelectedFiles(t *testing.T) {
+	path, _ := testTorrent(t)
+
+	tor := loadTestTorrent(t, path)
+	tor.SelectedFiles = []int{1} // sub/b.bin, bytes 40000 to 50000
+
+	d, err := tor.newDownloader(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := []bool{true, true, true, true}
+	picked := []int{}
+	for {
+		index, _, ok := d.Pick(all)
+		if !ok {
+			break
+		}
+		picked = append(picked, index)
+	}
+
+	if len(picked) != 2 || picked[0] != 2 || picked[1] != 3 {
+		t.Errorf("picked pieces %v, want [2 3]", picked)
+	}
+}
+
+func TestDownloaderSelectedFilesFinish(t *testing.T) {
+	path, seedDir := testTorrent(t)
+
+	seeder := loadTestTorrent(t, path)
+	seed, err := seeder.newDownloader(seedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor := loadTestTorrent(t, path)
+	tor.SelectedFiles = []int{1} // sub/b.bin, pieces 2 and 3
+	tor.Files[1].Attr = "x"
+
+	dir := t.TempDir()
+	d, err := tor.newDownloader(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		index, length, ok := d.Pick(seed.Bitfield())
+		if !ok {
+			break
+		}
+		data, err := seed.ReadBlock(index, 0, length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !d.Complete(index, data) {
+			t.Fatalf("piece %d rejected", index)
+		}
+	}
+
+	// Done without the rest of the torrent
+	select {
+	case <-tor.Completed():
+	default:
+		t.Fatal("download of the selected file not completed")
+	}
+	if tor.Left() == 0 {
+		t.Error("nothing left although a.bin was not downloaded")
+	}
+
+	// Finalize ran for the selected file only
+	stat, err := os.Stat(filepath.Join(dir, "data", "sub", "b.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode()&0o100 == 0 {
+		t.Errorf("executable selected file has mode %v", stat.Mode())
+	}
+}
@@ -0,0 +1,65 @@
+package torrent
+
+import "net"
+
+// IPv6 tracker extension.
+// https://www.bittorrent.org/beps/bep_0007.html
+
+// Address families to announce to a tracker host over.
+// Returns both "4" and "6" if the host resolves to addresses of both and
+// we have a public address in both, or a single empty family otherwise.
+// Behind a proxy the proxy decides.
+func addressFamilies(host string) []string {
+	if net.ParseIP(host) != nil || trackerClient().proxied() {
+		return []string{""}
+	}
+
+	ipv4, ipv6 := localAddrs()
+	if ipv4 == nil || ipv6 == nil {
+		return []string{""}
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return []string{""}
+	}
+
+	has4, has6 := false, false
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			has4 = true
+		} else {
+			has6 = true
+		}
+	}
+
+	if has4 && has6 {
+		return []string{"4", "6"}
+	}
+	return []string{""}
+}
+
+// Our public IPv4 and IPv6 addresses, if the host has any.
+// Addresses behind a NAT are not known here and are left out.
+func localAddrs() (ipv4, ipv6 net.IP) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, nil
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() {
+			continue
+		}
+
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			if ipv4 == nil {
+				ipv4 = ip4
+			}
+		} else if ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+	return ipv4, ipv6
+}
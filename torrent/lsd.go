@@ -0,0 +1,119 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AcidOP/torrly/lsd"
+	"github.com/AcidOP/torrly/peers"
+)
+
+// lsdSource announces a swarm on the local network and hands out
+// the local peers announcing it (BEP 14).
+type lsdSource struct {
+	service  *lsd.Service
+	infoHash hash
+	peers    chan []peers.Peer
+
+	mu     sync.Mutex // Guards sends on peers against Stop closing it
+	closed bool
+
+	once sync.Once
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (t *Torrent) newLSDSource(infoHash hash) *lsdSource {
+	return &lsdSource{
+		service:  t.LSD,
+		infoHash: infoHash,
+		peers:    make(chan []peers.Peer, 16),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Announce starts announcing on the first call, later calls announce
+// again unless the last announce was less than a minute ago.
+func (s *lsdSource) Announce() error {
+	first := false
+	s.once.Do(func() { first = true })
+	if first {
+		s.service.Subscribe(s.infoHash, func(addr *net.TCPAddr) {
+			s.deliver(peers.Peer{IP: addr.IP, Port: addr.Port, Local: true})
+		})
+		go s.run()
+		return nil
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *lsdSource) Peers() <-chan []peers.Peer {
+	return s.peers
+}
+
+func (s *lsdSource) Stop() {
+	s.once.Do(func() { close(s.done) })
+	s.service.Unsubscribe(s.infoHash)
+
+	close(s.stop)
+	<-s.done
+
+	// The LSD service may still be calling deliver
+	s.mu.Lock()
+	s.closed = true
+	close(s.peers)
+	s.mu.Unlock()
+}
+
+// Pass a local peer on, dropping it if the discovery is falling behind.
+// It announces itself again within a few minutes.
+func (s *lsdSource) deliver(p peers.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.peers <- []peers.Peer{p}:
+	default:
+	}
+}
+
+func (s *lsdSource) run() {
+	defer close(s.done)
+
+	for {
+		if err := s.service.Announce(s.infoHash); err != nil {
+			fmt.Println("LSD announce failed:", err)
+		}
+		last := time.Now()
+
+		timer := time.NewTimer(lsd.AnnounceInterval)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+
+			// Local peers are told about us at most once a minute
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(time.Until(last.Add(lsd.MinAnnounceInterval))):
+			}
+		}
+	}
+}
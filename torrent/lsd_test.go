@@ -0,0 +1,24 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AcidOP/torrly/lsd"
+	"github.com/AcidOP/torrly/peers"
+)
+
+func TestLSDSourceDeliverAfterStop(t *testing.T) {
+	tor := &Torrent{LSD: &lsd.Service{}}
+	s := tor.newLSDSource(hash{1})
+
+	s.deliver(peers.Peer{IP: net.IPv4(192, 168, 1, 2), Port: 6881})
+	if pArr := <-s.Peers(); len(pArr) != 1 {
+		t.Errorf("delivered %d peers, want 1", len(pArr))
+	}
+
+	s.Stop()
+
+	// Announces still in flight in the LSD service are dropped
+	s.deliver(peers.Peer{IP: net.IPv4(192, 168, 1, 3), Port: 6881})
+}
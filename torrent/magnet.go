@@ -0,0 +1,154 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet holds the fields of a magnet URI.
+// https://www.bittorrent.org/beps/bep_0009.html
+type Magnet struct {
+	InfoHash    hash     // v1 info hash from `xt=urn:btih:`
+	InfoHashV2  [32]byte // v2 info hash from `xt=urn:btmh:`
+	HasV1       bool     // Whether a v1 info hash was present
+	HasV2       bool     // Whether a v2 info hash was present
+	DisplayName string   // `dn`
+	Trackers    []string // `tr`, in the order they appear
+	WebSeeds    []string // `ws`
+	Peers       []string // `x.pe`, as host:port
+	SelectOnly  []int    // `so`, file indices to download
+}
+
+// Most file indices a `so` parameter may expand to, so that a range like
+// "0-2000000000" is rejected instead of allocated.
+const maxSelectOnly = 100000
+
+// Prefix of a SHA-256 multihash: hash function code 0x12, digest length 0x20.
+const multihashSHA256 = "1220"
+
+// Parse a magnet URI into its components.
+// At least one of `urn:btih:` or `urn:btmh:` must be present.
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet URI: %v", err)
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet URI: scheme %q", u.Scheme)
+	}
+
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet query: %v", err)
+	}
+
+	m := &Magnet{
+		DisplayName: q.Get("dn"),
+		Trackers:    q["tr"],
+		WebSeeds:    q["ws"],
+		Peers:       q["x.pe"],
+	}
+
+	for _, xt := range q["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			if m.InfoHash, err = decodeBtih(strings.TrimPrefix(xt, "urn:btih:")); err != nil {
+				return nil, err
+			}
+			m.HasV1 = true
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			if m.InfoHashV2, err = decodeBtmh(strings.TrimPrefix(xt, "urn:btmh:")); err != nil {
+				return nil, err
+			}
+			m.HasV2 = true
+		}
+	}
+
+	if !m.HasV1 && !m.HasV2 {
+		return nil, errors.New("magnet URI has no urn:btih or urn:btmh exact topic")
+	}
+
+	if so := q.Get("so"); so != "" {
+		if m.SelectOnly, err = parseSelectOnly(so); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Decode a v1 info hash, either 40 hex characters or 32 base32 characters.
+func decodeBtih(s string) (hash, error) {
+	var h hash
+
+	switch len(s) {
+	case 40:
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return h, fmt.Errorf("invalid hex info hash %q: %v", s, err)
+		}
+		copy(h[:], b)
+	case 32:
+		b, err := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		if err != nil {
+			return h, fmt.Errorf("invalid base32 info hash %q: %v", s, err)
+		}
+		copy(h[:], b)
+	default:
+		return h, fmt.Errorf("invalid info hash length: %d", len(s))
+	}
+	return h, nil
+}
+
+// Decode a v2 info hash, given as a hex encoded SHA-256 multihash.
+func decodeBtmh(s string) ([32]byte, error) {
+	var h [32]byte
+
+	if len(s) != len(multihashSHA256)+64 || !strings.HasPrefix(s, multihashSHA256) {
+		return h, fmt.Errorf("unsupported multihash %q: expected SHA-256", s)
+	}
+
+	b, err := hex.DecodeString(s[len(multihashSHA256):])
+	if err != nil {
+		return h, fmt.Errorf("invalid hex multihash %q: %v", s, err)
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// Parse the `so` parameter, a comma separated list of indices and ranges.
+// (e.g. "0,2,4-6" => [0 2 4 5 6])
+func parseSelectOnly(s string) ([]int, error) {
+	indices := []int{}
+
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid select-only index %q", part)
+		}
+
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, fmt.Errorf("invalid select-only range %q", part)
+			}
+		}
+
+		if end-start >= maxSelectOnly-len(indices) {
+			return nil, fmt.Errorf("select-only list has more than %d indices", maxSelectOnly)
+		}
+
+		for i := start; i <= end; i++ {
+			indices = append(indices, i)
+		}
+	}
+	return indices, nil
+}
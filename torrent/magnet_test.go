@@ -0,0 +1,192 @@
+package torrent
+
+import (
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseSelectOnly(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int
+		ok   bool
+	}{
+		{"0", []int{0}, true},
+		{"0,2,4-6", []int{0, 2, 4, 5, 6}, true},
+		{"3-3", []int{3}, true},
+		{"0-" + strconv.Itoa(maxSelectOnly-1), nil, true},
+		{"", nil, false},
+		{"-1", nil, false},
+		{"a", nil, false},
+		{"6-4", nil, false},
+		{"0-2000000000", nil, false},
+		{"0-" + strconv.Itoa(maxSelectOnly), nil, false},
+		{"0-60000,0-60000", nil, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSelectOnly(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseSelectOnly(%q) error = %v, want ok = %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.want != nil && !slices.Equal(got, tt.want) {
+			t.Errorf("parseSelectOnly(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseMagnetSelectOnlyTooLarge(t *testing.T) {
+	uri := "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&so=0-2000000000"
+	if _, err := ParseMagnet(uri); err == nil {
+		t.Error("magnet with a two billion file range was accepted")
+	}
+}
+
+func TestNewTorrentFromMagnet(t *testing.T) {
+	const (
+		btihHex    = "0123456789abcdef0123456789abcdef01234567"
+		btihBase32 = "AERUKZ4JVPG66AJDIVTYTK6N54ASGRLH"
+		btmh       = "1220" + "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	)
+	v1 := hash{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67}
+	var v2 [32]byte
+	for i := range v2 {
+		v2[i] = byte(i%16) * 0x11
+	}
+
+	tests := []struct {
+		name  string
+		uri   string
+		check func(t *testing.T, tor *Torrent)
+	}{
+		{
+			name: "hex btih",
+			uri:  "magnet:?xt=urn:btih:" + btihHex,
+			check: func(t *testing.T, tor *Torrent) {
+				if !tor.HasV1 || tor.HasV2 || tor.InfoHash != v1 {
+					t.Errorf("v1 = %v %x, v2 = %v", tor.HasV1, tor.InfoHash, tor.HasV2)
+				}
+			},
+		},
+		{
+			name: "base32 btih",
+			uri:  "magnet:?xt=urn:btih:" + btihBase32,
+			check: func(t *testing.T, tor *Torrent) {
+				if !tor.HasV1 || tor.InfoHash != v1 {
+					t.Errorf("info hash = %x, want %x", tor.InfoHash, v1)
+				}
+			},
+		},
+		{
+			name: "lower case base32 btih",
+			uri:  "magnet:?xt=urn:btih:" + strings.ToLower(btihBase32),
+			check: func(t *testing.T, tor *Torrent) {
+				if tor.InfoHash != v1 {
+					t.Errorf("info hash = %x, want %x", tor.InfoHash, v1)
+				}
+			},
+		},
+		{
+			name: "btmh",
+			uri:  "magnet:?xt=urn:btmh:" + btmh,
+			check: func(t *testing.T, tor *Torrent) {
+				if tor.HasV1 || !tor.HasV2 || tor.InfoHashV2 != v2 {
+					t.Errorf("v1 = %v, v2 = %v %x", tor.HasV1, tor.HasV2, tor.InfoHashV2)
+				}
+			},
+		},
+		{
+			name: "hybrid",
+			uri:  "magnet:?xt=urn:btih:" + btihHex + "&xt=urn:btmh:" + btmh,
+			check: func(t *testing.T, tor *Torrent) {
+				if !tor.HasV1 || !tor.HasV2 || tor.InfoHash != v1 || tor.InfoHashV2 != v2 {
+					t.Errorf("v1 = %v %x, v2 = %v %x", tor.HasV1, tor.InfoHash, tor.HasV2, tor.InfoHashV2)
+				}
+			},
+		},
+		{
+			name: "display name",
+			uri:  "magnet:?xt=urn:btih:" + btihHex + "&dn=ubuntu+24.04.iso",
+			check: func(t *testing.T, tor *Torrent) {
+				if tor.Name != "ubuntu 24.04.iso" {
+					t.Errorf("name = %q", tor.Name)
+				}
+			},
+		},
+		{
+			name: "repeated tr",
+			uri: "magnet:?xt=urn:btih:" + btihHex +
+				"&tr=" + url.QueryEscape("udp://a.example:6969/announce") +
+				"&tr=" + url.QueryEscape("http://b.example/announce?passkey=1"),
+			check: func(t *testing.T, tor *Torrent) {
+				want := [][]string{{"udp://a.example:6969/announce"}, {"http://b.example/announce?passkey=1"}}
+				if !slices.EqualFunc(tor.AnnounceList, want, slices.Equal) || tor.Announce != want[0][0] {
+					t.Errorf("announce = %q, tiers = %q, want one tier per tr in order", tor.Announce, tor.AnnounceList)
+				}
+			},
+		},
+		{
+			name: "ws",
+			uri:  "magnet:?xt=urn:btih:" + btihHex + "&ws=" + url.QueryEscape("https://mirror.example/files/"),
+			check: func(t *testing.T, tor *Torrent) {
+				if !slices.Equal(tor.WebSeeds, []string{"https://mirror.example/files/"}) {
+					t.Errorf("web seeds = %q", tor.WebSeeds)
+				}
+			},
+		},
+		{
+			name: "x.pe",
+			uri:  "magnet:?xt=urn:btih:" + btihHex + "&x.pe=10.0.0.1:6881&x.pe=" + url.QueryEscape("[::1]:6882"),
+			check: func(t *testing.T, tor *Torrent) {
+				if !slices.Equal(tor.DirectPeers, []string{"10.0.0.1:6881", "[::1]:6882"}) {
+					t.Errorf("direct peers = %q", tor.DirectPeers)
+				}
+			},
+		},
+		{
+			name: "so",
+			uri:  "magnet:?xt=urn:btih:" + btihHex + "&so=0,2,4-6",
+			check: func(t *testing.T, tor *Torrent) {
+				if !slices.Equal(tor.SelectedFiles, []int{0, 2, 4, 5, 6}) {
+					t.Errorf("selected files = %v", tor.SelectedFiles)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor, err := NewTorrentFromMagnet(tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Nothing but the info dictionary can tell the size
+			if !tor.MissingMetadata || tor.Left() == 0 {
+				t.Errorf("missing metadata = %v, left = %d", tor.MissingMetadata, tor.Left())
+			}
+			tt.check(t, tor)
+		})
+	}
+}
+
+func TestNewTorrentFromMagnetInvalid(t *testing.T) {
+	tests := []string{
+		"http://example.com/?xt=urn:btih:0123456789abcdef0123456789abcdef01234567",
+		"magnet:?dn=no+info+hash",
+		"magnet:?xt=urn:btih:0123",
+		"magnet:?xt=urn:btih:zz23456789abcdef0123456789abcdef01234567",
+		"magnet:?xt=urn:btmh:1114" + strings.Repeat("00", 20),
+		"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&so=x",
+	}
+
+	for _, uri := range tests {
+		if _, err := NewTorrentFromMagnet(uri); err == nil {
+			t.Errorf("NewTorrentFromMagnet(%q) succeeded", uri)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/AcidOP/torrly/bencode"
+	"github.com/AcidOP/torrly/peers"
+)
+
+// FetchMetadata downloads the info dictionary from the swarm (BEP 9)
+// and fills in the pieces, lengths and files of the torrent.
+// https://www.bittorrent.org/beps/bep_0009.html
+func (t *Torrent) FetchMetadata() error {
+	if !t.MissingMetadata {
+		return nil
+	}
+
+	pArr := t.directPeers()
+
+	if len(t.swarmHashes()) == 0 {
+		return errors.New("torrent has no info hash")
+	}
+
+	if len(t.AnnounceList) > 0 {
+		trackerPeers, err := t.GetAvailablePeers()
+		if err != nil {
+			fmt.Println("Failed to get peers from tracker:", err)
+		}
+		pArr = append(pArr, trackerPeers...)
+	}
+
+	ih := t.swarmHashes()[0]
+
+	// Trackerless magnet links only have the DHT to go by
+	if t.DHT != nil && t.DHTAllowed() {
+		t.bootstrapDHT()
+		dhtPeers, err := t.DHT.GetPeers(ih)
+		if err != nil {
+			fmt.Println("Failed to get peers from the DHT:", err)
+		}
+		pArr = append(pArr, tcpPeers(dhtPeers)...)
+	}
+
+	if len(pArr) == 0 {
+		return errors.New("no peers available to fetch metadata from")
+	}
+
+	pm := peers.NewPeerManager(pArr, ih[:], []byte(t.PeerId))
+	pm.Port = t.Port
+	t.useDHT(pm)
+
+	rawInfo, err := pm.FetchMetadata(t.verifyMetadata)
+	if err != nil {
+		return err
+	}
+
+	name := t.Name
+	if err := t.setInfo(rawInfo); err != nil {
+		return err
+	}
+
+	// Prefer the name from the info dictionary, fall back to `dn`
+	if t.Name == "" {
+		t.Name = name
+	}
+	return nil
+}
+
+// Check that the metadata received from a peer matches our info hashes.
+func (t *Torrent) verifyMetadata(rawInfo []byte) error {
+	if h := sha1.Sum(rawInfo); t.HasV1 && h != t.InfoHash {
+		return fmt.Errorf("info hash mismatch: expected %x, got %x", t.InfoHash, h)
+	}
+
+	if h := sha256.Sum256(rawInfo); t.HasV2 && h != t.InfoHashV2 {
+		return fmt.Errorf("v2 info hash mismatch: expected %x, got %x", t.InfoHashV2, h)
+	}
+	return nil
+}
+
+// Convert the `host:port` peers of a magnet link into peers we can dial.
+// Peers that don't resolve are skipped.
+func (t *Torrent) directPeers() []peers.Peer {
+	pArr := []peers.Peer{}
+
+	for _, addr := range t.DirectPeers {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			fmt.Printf("Invalid peer address %q: %v\n", addr, err)
+			continue
+		}
+
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			fmt.Printf("Invalid peer port %q: %v\n", addr, err)
+			continue
+		}
+
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			fmt.Printf("Failed to resolve peer %q: %v\n", addr, err)
+			continue
+		}
+
+		pArr = append(pArr, peers.Peer{IP: ips[0], Port: p})
+	}
+	return pArr
+}
+
+// WriteTorrentFile writes a .torrent file for the torrent.
+// The info dictionary is written exactly as received so the info hash is kept.
+func (t *Torrent) WriteTorrentFile(path string) error {
+	if t.MissingMetadata || t.infoBytes == nil {
+		return errors.New("cannot write torrent file: metadata is missing")
+	}
+
+	bt := bcodeTorrent{
+		Announce:     t.Announce,
+		AnnounceList: t.tiers(),
+		Info:         t.infoBytes,
+	}
+
+	for _, n := range t.Nodes {
+		host, port, err := net.SplitHostPort(n)
+		if p, perr := strconv.Atoi(port); err == nil && perr == nil {
+			bt.Nodes = append(bt.Nodes, []any{host, p})
+		}
+	}
+
+	if len(t.PieceLayers) > 0 {
+		bt.PieceLayers = make(map[string]string, len(t.PieceLayers))
+		for root, hashes := range t.PieceLayers {
+			layer := make([]byte, 0, len(hashes)*len(root))
+			for _, h := range hashes {
+				layer = append(layer, h[:]...)
+			}
+			bt.PieceLayers[string(root[:])] = string(layer)
+		}
+	}
+
+	data, err := bencode.Marshal(bt)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,41 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteTorrentFileUnsortedInfo(t *testing.T) {
+	// As sent by a peer whose client doesn't sort its keys
+	rawInfo := []byte("d4:name4:test12:piece lengthi16384e6:lengthi100e6:pieces20:" + strings.Repeat("x", 20) + "e")
+	ih := sha1.Sum(rawInfo)
+
+	tor, err := NewTorrentFromMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString(ih[:]) + "&tr=http://t.example/an")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What FetchMetadata does with the metadata once a peer sent it
+	if err := tor.verifyMetadata(rawInfo); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.setInfo(rawInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	if err := tor.WriteTorrentFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := NewTorrentFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written.InfoHash != ih || string(written.infoBytes) != string(rawInfo) {
+		t.Errorf("written info hash = %x, want %x", written.InfoHash, ih)
+	}
+}
@@ -0,0 +1,31 @@
+package torrent
+
+// Peer sources besides trackers, enabled for all torrents by default.
+// Private torrents (BEP 27) never use them, regardless of these settings.
+// https://www.bittorrent.org/beps/bep_0027.html
+var (
+	EnableDHT = true // Mainline DHT (BEP 5)
+	EnablePEX = true // Peer exchange (BEP 11)
+	EnableLSD = true // Local service discovery (BEP 14)
+)
+
+// Whether peers may be looked up and announced on the DHT.
+func (t *Torrent) DHTAllowed() bool {
+	return EnableDHT && !t.Private
+}
+
+// Whether peers may be exchanged with other peers.
+func (t *Torrent) PEXAllowed() bool {
+	return EnablePEX && !t.Private
+}
+
+// Whether peers may be discovered on the local network.
+func (t *Torrent) LSDAllowed() bool {
+	return EnableLSD && !t.Private
+}
+
+// Whether peers may come from anywhere other than the torrent's trackers,
+// such as the `x.pe` peers of a magnet link.
+func (t *Torrent) untrackedPeersAllowed() bool {
+	return !t.Private
+}
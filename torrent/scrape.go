@@ -0,0 +1,240 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Tracker scrape convention.
+// https://www.bittorrent.org/beps/bep_0048.html
+
+type scrapeResponse struct {
+	FailureReason string                  `bencode:"failure reason"`
+	Files         map[string]ScrapeResult `bencode:"files"` // Keyed by the raw 20-byte info hash
+}
+
+// Derive the scrape URL of an HTTP tracker from its announce URL.
+// Only trackers whose last path component starts with "announce" support
+// scraping, e.g. http://example.com/x/announce.php becomes .../x/scrape.php
+func scrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", fmt.Errorf("tracker %s does not support scrape", announce)
+	}
+
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	return u.String(), nil
+}
+
+// ScrapeTracker asks a single tracker for the swarm statistics of several
+// torrents at once. Info hashes the tracker doesn't know are left out.
+func ScrapeTracker(announce string, infoHashes ...hash) (map[hash]ScrapeResult, error) {
+	if len(infoHashes) == 0 {
+		return nil, errors.New("no info hashes to scrape")
+	}
+
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return scrapeUDP(u.Host, infoHashes)
+	case "http", "https":
+		return scrapeHTTP(announce, infoHashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+func scrapeUDP(addr string, infoHashes []hash) (map[hash]ScrapeResult, error) {
+	res, err := udpTrackerFor("udp", addr).Scrape(infoHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	results := map[hash]ScrapeResult{}
+	for i, ih := range infoHashes {
+		results[ih] = res[i]
+	}
+	return results, nil
+}
+
+func scrapeHTTP(announce string, infoHashes []hash) (map[hash]ScrapeResult, error) {
+	client := trackerClient()
+
+	base, err := scrapeURL(client.rewrite(announce))
+	if err != nil {
+		return nil, err
+	}
+
+	u, _ := url.Parse(base)
+	params := u.Query()
+	for _, ih := range infoHashes {
+		params.Add("info_hash", string(ih[:]))
+	}
+	u.RawQuery = params.Encode()
+
+	status, data, err := client.get(u.String(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	var sr scrapeResponse
+	decodeErr := unmarshalLenient(data, &sr)
+
+	if status != http.StatusOK {
+		return nil, &TrackerError{URL: announce, StatusCode: status, Reason: sr.FailureReason}
+	}
+	if sr.FailureReason != "" {
+		return nil, &TrackerError{URL: announce, Reason: sr.FailureReason}
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	results := map[hash]ScrapeResult{}
+	for key, res := range sr.Files {
+		if len(key) != len(hash{}) {
+			continue
+		}
+		results[hash([]byte(key))] = res
+	}
+	return results, nil
+}
+
+// Scrape returns the swarm statistics of the torrent from the first
+// tracker, in tier order, that answers.
+// For hybrid torrents these are the statistics of the v1 swarm.
+func (t *Torrent) Scrape() (*ScrapeResult, error) {
+	hashes := t.swarmHashes()
+	if len(hashes) == 0 {
+		return nil, errors.New("torrent has no info hash")
+	}
+	if len(t.AnnounceList) == 0 {
+		return nil, errors.New("torrent has no trackers")
+	}
+
+	errs := []error{}
+	for _, tier := range t.tiers() {
+		for _, announce := range tier {
+			results, err := ScrapeTracker(announce, hashes[0])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("tracker %s: %w", announce, err))
+				continue
+			}
+
+			res, ok := results[hashes[0]]
+			if !ok {
+				errs = append(errs, fmt.Errorf("tracker %s: torrent not found", announce))
+				continue
+			}
+			return &res, nil
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+const (
+	maxConcurrentScrapes = 16
+	scrapeTimeout        = 30 * time.Second // Trackers still silent by then are reported as failed
+)
+
+type scrapeReply struct {
+	announce string
+	results  map[hash]ScrapeResult
+	err      error
+}
+
+// ScrapeMany scrapes several torrents, asking each tracker about all the
+// torrents it serves in a single request. Trackers are scraped concurrently.
+// Returns, for each torrent, the results keyed by announce URL, along with
+// the errors of the trackers that didn't answer.
+func ScrapeMany(torrents []*Torrent) ([]map[string]ScrapeResult, map[string]error) {
+	results := make([]map[string]ScrapeResult, len(torrents))
+	batches := map[string][]hash{}
+	order := []string{}
+
+	for i, t := range torrents {
+		results[i] = map[string]ScrapeResult{}
+
+		hashes := t.swarmHashes()
+		if len(hashes) == 0 {
+			continue
+		}
+
+		for _, tier := range t.tiers() {
+			for _, announce := range tier {
+				if _, ok := batches[announce]; !ok {
+					order = append(order, announce)
+				}
+				batches[announce] = append(batches[announce], hashes[0])
+			}
+		}
+	}
+
+	replies := make(chan scrapeReply, len(order))
+	sem := make(chan struct{}, maxConcurrentScrapes)
+	for _, announce := range order {
+		go func(announce string) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			res, err := ScrapeTracker(announce, batches[announce]...)
+			replies <- scrapeReply{announce: announce, results: res, err: err}
+		}(announce)
+	}
+
+	pending := map[string]bool{}
+	for _, announce := range order {
+		pending[announce] = true
+	}
+
+	timeout := time.NewTimer(scrapeTimeout)
+	defer timeout.Stop()
+
+	errs := map[string]error{}
+	for len(pending) > 0 {
+		select {
+		case r := <-replies:
+			delete(pending, r.announce)
+			if r.err != nil {
+				errs[r.announce] = r.err
+				continue
+			}
+
+			for i, t := range torrents {
+				hashes := t.swarmHashes()
+				if len(hashes) == 0 {
+					continue
+				}
+				if res, ok := r.results[hashes[0]]; ok {
+					results[i][r.announce] = res
+				}
+			}
+
+		case <-timeout.C:
+			for announce := range pending {
+				errs[announce] = errors.New("no answer in time")
+			}
+			return results, errs
+		}
+	}
+	return results, errs
+}
+
+func (sr ScrapeResult) Show() {
+	fmt.Println("    ✅ Seeders (complete):", sr.Complete)
+	fmt.Println("    🔄 Leechers (incomplete):", sr.Incomplete)
+	fmt.Println("    📥 Downloaded:", sr.Downloaded)
+}
@@ -0,0 +1,65 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// An HTTP tracker answering scrapes for `ih` with unsorted keys, like
+// some trackers in the wild do.
+func newScrapeServer(t *testing.T, ih hash) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("d5:filesd20:" + string(ih[:]) + "d10:incompletei10e8:completei5e10:downloadedi50eeee"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestScrapeHTTPUnsortedKeys(t *testing.T) {
+	ih := hash{1, 2, 3}
+	srv := newScrapeServer(t, ih)
+
+	results, err := ScrapeTracker(srv.URL+"/announce", ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ScrapeResult{Complete: 5, Downloaded: 50, Incomplete: 10}
+	if got, ok := results[ih]; !ok || got != want {
+		t.Errorf("scrape = %+v, want %+v", results, want)
+	}
+}
+
+func TestScrapeMany(t *testing.T) {
+	ih := hash{1, 2, 3}
+	good := newScrapeServer(t, ih)
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	torrents := []*Torrent{
+		{InfoHash: ih, HasV1: true, AnnounceList: [][]string{{good.URL + "/announce"}, {down.URL + "/announce"}}},
+		{InfoHash: hash{9}, HasV1: true, AnnounceList: [][]string{{good.URL + "/announce"}}},
+	}
+
+	results, errs := ScrapeMany(torrents)
+
+	if got := results[0][good.URL+"/announce"]; got.Complete != 5 {
+		t.Errorf("first torrent = %+v, want 5 seeders from %s", results[0], good.URL)
+	}
+	if len(results[1]) != 0 {
+		t.Errorf("unknown torrent = %+v, want no results", results[1])
+	}
+	if len(errs) != 1 || errs[down.URL+"/announce"] == nil {
+		t.Errorf("errors = %v, want one for %s", errs, down.URL)
+	}
+}
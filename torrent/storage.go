@@ -0,0 +1,254 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Storage maps pieces of the torrent data onto the files of a download directory.
+// Padding files are never created, their zero bytes are synthesized on read.
+type Storage struct {
+	root        string // Directory the torrent's files are stored in
+	files       []File
+	pieceLength int
+	length      int
+	perFile     bool // Pieces don't span files, as in v2-only torrents (BEP 52)
+}
+
+// Create the storage for the torrent inside the directory `dir`.
+// Multi-file torrents get their own sub-directory named after the torrent.
+func (t *Torrent) NewStorage(dir string) (*Storage, error) {
+	if t.MissingMetadata {
+		return nil, errors.New("cannot create storage: metadata is missing")
+	}
+
+	// The name is the file name of single-file torrents, and the
+	// directory name of multi-file ones: either way it must stay in `dir`
+	if !validPathComponent(t.Name) {
+		return nil, fmt.Errorf("invalid torrent name: %q", t.Name)
+	}
+
+	root := dir
+	if !t.singleFile {
+		root = filepath.Join(dir, t.Name)
+	}
+
+	for _, f := range t.Files {
+		if !filepath.IsLocal(f.Path) {
+			return nil, fmt.Errorf("invalid file path: %q", f.Path)
+		}
+	}
+
+	return &Storage{
+		root:        root,
+		files:       t.Files,
+		pieceLength: t.PieceLength,
+		length:      t.dataLength(),
+		perFile:     t.HasV2 && !t.HasV1,
+	}, nil
+}
+
+// Byte range [begin, end) of a piece within the torrent data.
+func (s *Storage) pieceBounds(index int) (int, int, error) {
+	begin := index * s.pieceLength
+	if index < 0 || begin >= s.length {
+		return 0, 0, fmt.Errorf("piece index out of range: %d", index)
+	}
+	end := min(begin+s.pieceLength, s.length)
+	if !s.perFile {
+		return begin, end, nil
+	}
+
+	// The last piece of a file ends with the file
+	for _, f := range s.files {
+		if f.Length > 0 && begin >= f.Offset && begin < f.Offset+f.Length {
+			return begin, min(end, f.Offset+f.Length), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("piece %d is in no file", index)
+}
+
+// Call `fn` for every file overlapping the byte range [begin, end),
+// with the offset inside the file and the matching part of `buf`.
+func (s *Storage) forEachSegment(begin, end int, buf []byte,
+	fn func(f File, fileOffset int, segment []byte) error) error {
+	for _, f := range s.files {
+		fileEnd := f.Offset + f.Length
+		if f.Length == 0 || fileEnd <= begin || f.Offset >= end {
+			continue
+		}
+
+		from := max(begin, f.Offset)
+		to := min(end, fileEnd)
+
+		if err := fn(f, from-f.Offset, buf[from-begin:to-begin]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WritePiece writes the data of a verified piece to the files it spans.
+// Padding files and symlinks are skipped.
+func (s *Storage) WritePiece(index int, data []byte) error {
+	begin, end, err := s.pieceBounds(index)
+	if err != nil {
+		return err
+	}
+
+	if len(data) != end-begin {
+		return fmt.Errorf("piece %d has %d bytes, expected %d", index, len(data), end-begin)
+	}
+
+	return s.forEachSegment(begin, end, data, func(f File, offset int, segment []byte) error {
+		if f.IsPadding() || f.IsSymlink() {
+			return nil
+		}
+
+		path := filepath.Join(s.root, f.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = file.WriteAt(segment, int64(offset))
+		return err
+	})
+}
+
+// ReadPiece reads a piece back from disk.
+// The content of padding files is always zeros.
+func (s *Storage) ReadPiece(index int) ([]byte, error) {
+	begin, end, err := s.pieceBounds(index)
+	if err != nil {
+		return nil, err
+	}
+	return s.readRange(begin, end)
+}
+
+// ReadBlock reads `length` bytes at offset `begin` of a piece, e.g. to
+// serve a peer's request.
+func (s *Storage) ReadBlock(index, begin, length int) ([]byte, error) {
+	pieceBegin, pieceEnd, err := s.pieceBounds(index)
+	if err != nil {
+		return nil, err
+	}
+
+	if begin < 0 || length <= 0 || begin+length > pieceEnd-pieceBegin {
+		return nil, fmt.Errorf("block %d+%d out of range of piece %d", begin, length, index)
+	}
+	return s.readRange(pieceBegin+begin, pieceBegin+begin+length)
+}
+
+// Read the byte range [begin, end) of the torrent data.
+func (s *Storage) readRange(begin, end int) ([]byte, error) {
+	data := make([]byte, end-begin)
+
+	err := s.forEachSegment(begin, end, data, func(f File, offset int, segment []byte) error {
+		if f.IsPadding() || f.IsSymlink() {
+			clear(segment)
+			return nil
+		}
+
+		file, err := os.Open(filepath.Join(s.root, f.Path))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		n, err := file.ReadAt(segment, int64(offset))
+		if n < len(segment) {
+			if err == nil || err == io.EOF {
+				return fmt.Errorf("file %s is shorter than expected", f.Path)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// VerifyPiece checks the data on disk against the v1 hash of the piece.
+func (s *Storage) VerifyPiece(index int, expected hash) (bool, error) {
+	data, err := s.ReadPiece(index)
+	if err != nil {
+		return false, err
+	}
+
+	h := sha1.Sum(data)
+	return bytes.Equal(h[:], expected[:]), nil
+}
+
+// Finalize applies the file attributes once the download is complete:
+// executable files get their execute bits and symlinks are created.
+// Only the files at the `selected` indices are touched, every file if empty.
+func (s *Storage) Finalize(selected []int) error {
+	for i, f := range s.files {
+		if f.IsPadding() || (len(selected) > 0 && !slices.Contains(selected, i)) {
+			continue
+		}
+
+		path := filepath.Join(s.root, f.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+
+		if f.IsSymlink() {
+			if err := s.createSymlink(path, f.SymlinkPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Empty files have no pieces, so they are never written
+		if f.Length == 0 {
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+			if err != nil {
+				return err
+			}
+			file.Close()
+		}
+
+		if f.IsExecutable() {
+			stat, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+
+			// Grant execute to everyone who can read the file
+			mode := stat.Mode() | (stat.Mode()&0o444)>>2
+			if err := os.Chmod(path, mode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Create a symlink at `path` pointing to `target`, which is relative
+// to the torrent's root directory. An existing file at `path` is replaced.
+func (s *Storage) createSymlink(path, target string) error {
+	rel, err := filepath.Rel(filepath.Dir(path), filepath.Join(s.root, target))
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(rel, path)
+}
@@ -0,0 +1,185 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// Multitracker metadata extension.
+// https://www.bittorrent.org/beps/bep_0012.html
+
+// Build the tracker tiers of a torrent file.
+// `announce-list` takes precedence over `announce` when present.
+// Trackers are shuffled within each tier, as required by BEP 12.
+func buildTiers(announce string, announceList [][]string) [][]string {
+	tiers := [][]string{}
+
+	for _, tier := range announceList {
+		trackers := []string{}
+		for _, tr := range tier {
+			if tr != "" {
+				trackers = append(trackers, tr)
+			}
+		}
+
+		if len(trackers) == 0 {
+			continue
+		}
+
+		rand.Shuffle(len(trackers), func(i, j int) {
+			trackers[i], trackers[j] = trackers[j], trackers[i]
+		})
+		tiers = append(tiers, trackers)
+	}
+
+	if len(tiers) == 0 && announce != "" {
+		tiers = append(tiers, []string{announce})
+	}
+	return tiers
+}
+
+// Try the tiers in order and return the response of the first tracker that responds.
+func (t *Torrent) announceTiers(infoHash hash, event string) (*TrackerResponse, error) {
+	errs := []error{}
+
+	for i := range t.AnnounceList {
+		tr, err := t.announceTier(i, infoHash, event)
+		if err == nil {
+			return tr, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Announce to every tier concurrently and merge the responses of all tiers.
+// Fails only if no tier had a tracker that responded.
+func (t *Torrent) announceAllTiers(infoHash hash, event string) (*TrackerResponse, error) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []*TrackerResponse
+		errs    []error
+	)
+
+	for i := range t.AnnounceList {
+		wg.Add(1)
+		go func(tier int) {
+			defer wg.Done()
+
+			tr, err := t.announceTier(tier, infoHash, event)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			results = append(results, tr)
+		}(i)
+	}
+	wg.Wait()
+
+	if len(results) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return mergeResponses(results...), nil
+}
+
+// Try the trackers of a tier in order. The first one that responds is moved
+// to the front of its tier so it is tried first on the next announce.
+func (t *Torrent) announceTier(tier int, infoHash hash, event string) (*TrackerResponse, error) {
+	trackers := t.tiers()[tier]
+	errs := []error{}
+
+	for _, announce := range trackers {
+		if err := t.beginAnnounce(announce, event); err != nil {
+			errs = append(errs, fmt.Errorf("tracker %s: %w", announce, err))
+			continue
+		}
+
+		tr, err := t.announce(announce, infoHash, event)
+		t.endAnnounce(announce, tr, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tracker %s: %w", announce, err))
+			continue
+		}
+
+		tr.Show()
+
+		t.promoteTracker(tier, announce)
+		return tr, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// A copy of the tracker tiers, safe to use while announces reorder them.
+func (t *Torrent) tiers() [][]string {
+	t.trackerMu.Lock()
+	defer t.trackerMu.Unlock()
+
+	tiers := make([][]string, len(t.AnnounceList))
+	for i, tier := range t.AnnounceList {
+		tiers[i] = slices.Clone(tier)
+	}
+	return tiers
+}
+
+// Move a tracker to the front of its tier. Swarms of hybrid torrents
+// announce concurrently, so the tier may have changed since it was read.
+func (t *Torrent) promoteTracker(tier int, announce string) {
+	t.trackerMu.Lock()
+	defer t.trackerMu.Unlock()
+
+	trackers := t.AnnounceList[tier]
+	if i := slices.Index(trackers, announce); i > 0 {
+		copy(trackers[1:i+1], trackers[:i])
+		trackers[0] = announce
+	}
+}
+
+// Merge tracker responses into one, dropping duplicate peers.
+// The shortest intervals win so no tracker is announced to too late.
+func mergeResponses(responses ...*TrackerResponse) *TrackerResponse {
+	merged := &TrackerResponse{}
+	seen := map[string]bool{}
+
+	for _, tr := range responses {
+		if merged.Interval == 0 || (tr.Interval > 0 && tr.Interval < merged.Interval) {
+			merged.Interval = tr.Interval
+		}
+		if merged.MinInterval == 0 || (tr.MinInterval > 0 && tr.MinInterval < merged.MinInterval) {
+			merged.MinInterval = tr.MinInterval
+		}
+		if merged.TrackerID == "" {
+			merged.TrackerID = tr.TrackerID
+		}
+		if merged.WarningMessage == "" {
+			merged.WarningMessage = tr.WarningMessage
+		}
+		merged.Completed = max(merged.Completed, tr.Completed)
+		merged.Incomplete = max(merged.Incomplete, tr.Incomplete)
+
+		merged.Peers = appendNewPeers(merged.Peers, tr.Peers, seen)
+		merged.Peers6 = peerList6(appendNewPeers(peerList(merged.Peers6), peerList(tr.Peers6), seen))
+	}
+	return merged
+}
+
+// Append the peers whose address hasn't been seen yet.
+func appendNewPeers(dst, src peerList, seen map[string]bool) peerList {
+	for _, p := range src {
+		addr := net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		dst = append(dst, p)
+	}
+	return dst
+}
@@ -0,0 +1,49 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestAnnounceTierPromotesResponder(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer up.Close()
+
+	tor := &Torrent{
+		AnnounceList: [][]string{{down.URL + "/a", down.URL + "/b", up.URL}},
+		PeerId:       PeerID,
+		Port:         Port,
+		Length:       1,
+	}
+
+	// The swarms of a hybrid torrent announce concurrently, while the
+	// tracker list may be read at any time
+	var wg sync.WaitGroup
+	for _, ih := range []hash{{1}, {2}} {
+		wg.Add(1)
+		go func(ih hash) {
+			defer wg.Done()
+			if _, err := tor.announceTier(0, ih, eventStarted); err != nil {
+				t.Error(err)
+			}
+		}(ih)
+	}
+	for i := 0; i < 10; i++ {
+		tor.Trackers()
+	}
+	wg.Wait()
+
+	tier := tor.tiers()[0]
+	if len(tier) != 3 || tier[0] != up.URL {
+		t.Errorf("tier = %q, want %s first", tier, up.URL)
+	}
+}
@@ -1,182 +1,614 @@
-package torrent
-
-import (
-	"bytes"
-	"crypto/sha1"
-	"errors"
-	"fmt"
-	"math"
-	"os"
-	"strings"
-
-	"github.com/AcidOP/torrly/peers"
-	"github.com/jackpal/bencode-go"
-)
-
-type hash = [20]byte
-
-type Torrent struct {
-	Name        string
-	Announce    string
-	InfoHash    hash
-	PieceHashes []hash // Array of 20-byte hashes for each piece
-	PieceLength int    // Number of bytes in each piece (e.g. 16 KB)
-	Length      int    // Total length of the file in bytes
-	PeerId      string // Our own Peer ID, used for handshakes.
-	Port        int    // Port we listen on for incoming connections
-}
-
-type bcodeInfo struct {
-	Name        string `bencode:"name"`
-	Pieces      string `bencode:"pieces"`       // Concatenated SHA1 hashes of each piece
-	PieceLength int    `bencode:"piece length"` // Length of each piece in bytes (e.g. 16 KB)
-	Length      int    `bencode:"length"`       // Total length of the file in bytes
-}
-
-type bcodeTorrent struct {
-	Announce string    `bencode:"announce"`
-	Info     bcodeInfo `bencode:"info"`
-}
-
-const (
-	PeerID = "-TRLY01-123456789012"
-	Port   = 6881
-)
-
-func NewTorrentFromFile(path string) (*Torrent, error) {
-	file, err := parseTorrentFromPath(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	return metaFromFile(file)
-}
-
-// Visualize information about the torrent.
-// (e.g. announce URL, file name, size, piece length, number of pieces, info hash)
-func (t *Torrent) ViewTorrent() {
-	var displaySize string
-
-	// Format the size in GB, MB, or KB
-	if s := t.Length / (1024 * 1024); s >= 1024 {
-		displaySize = fmt.Sprintf("%.2f GB", float64(s)/1024)
-	} else if s >= 1 {
-		displaySize = fmt.Sprintf("%.2f MB", float64(s))
-	} else {
-		displaySize = fmt.Sprintf("%d KB", t.Length/1024)
-	}
-
-	line := strings.Repeat("#", 70)
-
-	fmt.Println()
-	fmt.Println(line)
-	fmt.Printf("\nAnnounce: %s\n", t.Announce)
-	fmt.Printf("File name: %s\n", t.Name)
-	fmt.Printf("File size: %s\n", displaySize)
-	fmt.Printf("Piece length: %d KB\n", t.PieceLength/1024)
-	fmt.Printf("Number of pieces: %d\n", len(t.PieceHashes))
-	fmt.Printf("Info Hash: %x\n\n", t.InfoHash)
-	fmt.Println(line)
-	fmt.Println()
-}
-
-func (t *Torrent) StartDownload() {
-	pArr, err := t.GetAvailablePeers()
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	pm := peers.NewPeerManager(
-		pArr,
-		t.InfoHash[:],
-		[]byte(t.PeerId),
-	)
-	pm.HandlePeers()
-}
-
-// Takes a path as an argument and checks if the file is a .torrent file.
-// Then reads the file and a pointer to the file.
-func parseTorrentFromPath(path string) (*os.File, error) {
-	f, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		return nil, err
-	}
-
-	// Check the extension
-	if strings.Split(f.Name(), ".")[1] != "torrent" {
-		return nil, errors.New("file " + f.Name() + " is not a .torrent file")
-	}
-
-	return os.Open(path)
-}
-
-// Takes a file as argument and reads the torrent metadata from it.
-// Returns a Torrent struct with the metadata.
-func metaFromFile(f *os.File) (*Torrent, error) {
-	if f == nil {
-		return nil, errors.New("file pointer is nil")
-	}
-
-	bt := bcodeTorrent{}
-	if err := bencode.Unmarshal(f, &bt); err != nil {
-		return nil, errors.New("failed to parse torrent file: " + err.Error())
-	}
-
-	// SHA1 hash of `info` dictionary
-	iHash := bt.Info.hash()
-
-	// Split the pieces into an array of  hashes
-	pHashes, err := bt.Info.splitPieceHashes()
-	if err != nil {
-		return nil, err
-	}
-
-	t := &Torrent{
-		Announce:    bt.Announce,
-		InfoHash:    iHash,
-		PieceHashes: pHashes,
-		PieceLength: bt.Info.PieceLength,
-		Length:      bt.Info.Length,
-		Name:        bt.Info.Name,
-		PeerId:      PeerID,
-		Port:        Port,
-	}
-	return t, nil
-}
-
-// Calculate the SHA1 hash of the bencoded info dictionary.
-func (i bcodeInfo) hash() hash {
-	infoBytes := bytes.Buffer{}
-	if err := bencode.Marshal(&infoBytes, i); err != nil {
-		panic("failed to marshal info: " + err.Error())
-	}
-
-	return sha1.Sum(infoBytes.Bytes())
-}
-
-// Take the `info` key from meta and split the pieces into an array of hashes.
-// Returns an array of 20-byte hashes.
-func (i bcodeInfo) splitPieceHashes() ([]hash, error) {
-	hashLen := 20 // SHA1 is 20 bytes long
-
-	if len(i.Pieces)%hashLen != 0 {
-		return nil, errors.New("malformed pieces: " + fmt.Sprint(len(i.Pieces)))
-	}
-
-	numHashes := len(i.Pieces) / hashLen
-	expectedNumHashes := int(math.Ceil(float64(i.Length) / float64(i.PieceLength)))
-
-	if numHashes != expectedNumHashes {
-		return nil, fmt.Errorf("piece count mismatch: got %d hashes, expected %d (file size=%d, piece size=%d)",
-			numHashes, expectedNumHashes, i.Length, i.PieceLength)
-	}
-
-	hashes := make([]hash, numHashes)
-
-	for idx := 0; idx < numHashes; idx++ {
-		copy(hashes[idx][:], i.Pieces[idx*hashLen:(idx+1)*hashLen])
-	}
-	return hashes, nil
-}
+package torrent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/AcidOP/torrly/bencode"
+	"github.com/AcidOP/torrly/dht"
+	"github.com/AcidOP/torrly/lsd"
+	"github.com/AcidOP/torrly/peers"
+)
+
+type hash = [20]byte
+
+type Torrent struct {
+	Name            string
+	Announce        string
+	AnnounceList    [][]string // Tiers of tracker URLs (BEP 12)
+	AnnounceAll     bool       // Announce to all tiers concurrently instead of stopping at the first response
+	InfoHash        hash
+	InfoHashV2      [32]byte            // SHA-256 info hash of v2 torrents (zero if unknown)
+	HasV1           bool                // Whether the torrent carries v1 metadata (SHA-1 pieces)
+	HasV2           bool                // Whether the torrent carries v2 metadata (BEP 52)
+	PieceHashes     []hash              // Array of 20-byte hashes for each piece (v1 only)
+	PieceLength     int                 // Number of bytes in each piece (e.g. 16 KB)
+	PieceLayers     map[hashV2][]hashV2 // SHA-256 piece hashes per file, keyed by pieces root (v2 only)
+	Length          int                 // Total length of all files in bytes
+	Files           []File              // Files in the torrent, in the order they appear in the data
+	WebSeeds        []string            // HTTP(S) URLs serving the torrent data
+	DirectPeers     []string            // Peers to connect to without asking a tracker, as host:port
+	SelectedFiles   []int               // Indices of the files to download (empty means all)
+	MissingMetadata bool                // Set until the info dictionary is known (e.g. magnet links)
+	Private         bool                // Peers MUST only come from the torrent's trackers (BEP 27)
+	PeerId          string              // Our own Peer ID, used for handshakes.
+	Port            int                 // Port we listen on for incoming connections
+	NumWant         int                 // Number of peers to ask trackers for, 0 lets them decide
+	AnnounceIP      string              // Address trackers should hand out for us, empty uses the connection's
+	NoCompact       bool                // Ask HTTP trackers for a list of peer dictionaries instead of compact peers
+	Nodes           []string            // DHT nodes from the torrent file, as host:port
+	DHT             *dht.Node           // DHT node to find peers with, nil to not use the DHT
+	LSD             *lsd.Service        // Local service discovery, nil to not look for peers on the local network
+	DownloadDir     string              // Directory the files are saved in, the working directory if empty
+
+	infoBytes  []byte // Raw bencoded `info` dictionary, exactly as hashed
+	singleFile bool   // Single-file torrents are stored without a root directory
+
+	stats transferStats // Byte counters reported to trackers
+
+	trackerMu sync.Mutex
+	trackers  map[string]*TrackerStatus // Keyed by announce URL
+	keyOnce   sync.Once
+	key       uint32 // Identifies us to trackers across IP changes
+
+	mu          sync.Mutex
+	discoveries []*Discovery         // One per swarm while downloading
+	managers    []*peers.PeerManager // One per swarm while downloading
+	stopped     bool                 // Set by Stop
+}
+
+// File is a single entry of the torrent's file table.
+// Single-file torrents have exactly one entry named after the torrent.
+type File struct {
+	Path   string // Path relative to the torrent's root directory
+	Length int    // Length of the file in bytes
+	Offset int    // Byte offset of the file within the torrent data
+
+	PiecesRoot  hashV2 // Merkle root of the file's pieces (v2 only, zero for empty files)
+	Attr        string // File attributes (BEP 47), e.g. "p" for padding files
+	SymlinkPath string // Target of a symlink, relative to the torrent's root directory
+}
+
+type bcodeFile struct {
+	Length      int      `bencode:"length"`
+	Path        []string `bencode:"path"` // Path components, the last one is the file name
+	Attr        string   `bencode:"attr,omitempty"`
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
+}
+
+type bcodeInfo struct {
+	Name        string      `bencode:"name"`
+	Pieces      string      `bencode:"pieces"`           // Concatenated SHA1 hashes of each piece
+	PieceLength int         `bencode:"piece length"`     // Length of each piece in bytes (e.g. 16 KB)
+	Length      int         `bencode:"length,omitempty"` // Length of the file in bytes (single-file only)
+	Files       []bcodeFile `bencode:"files,omitempty"`  // File list (multi-file only)
+	MetaVersion int         `bencode:"meta version,omitempty"`
+	Private     int         `bencode:"private,omitempty"`
+	Source      string      `bencode:"source,omitempty"`
+	Attr        string      `bencode:"attr,omitempty"`         // Attributes of the file (single-file only)
+	SymlinkPath []string    `bencode:"symlink path,omitempty"` // Symlink target (single-file only)
+}
+
+type bcodeTorrent struct {
+	Announce     string                  `bencode:"announce,omitempty"`
+	AnnounceList [][]string              `bencode:"announce-list,omitempty"`
+	Comment      string                  `bencode:"comment,omitempty"`
+	CreatedBy    string                  `bencode:"created by,omitempty"`
+	CreationDate int64                   `bencode:"creation date,omitempty"`
+	Info         bencode.VerbatimMessage `bencode:"info"`                   // Exact bytes of the `info` dictionary, even with unsorted keys
+	PieceLayers  map[string]string       `bencode:"piece layers,omitempty"` // v2 only
+	URLList      []string                `bencode:"url-list,omitempty"`
+	Nodes        []any                   `bencode:"nodes,omitempty"` // DHT nodes as [host, port] pairs (BEP 5)
+}
+
+const (
+	PeerID = "-TRLY01-123456789012"
+	Port   = 6881
+)
+
+func NewTorrentFromFile(path string) (*Torrent, error) {
+	file, err := parseTorrentFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return metaFromFile(file)
+}
+
+// Create a Torrent from a magnet URI.
+// Only the info hash, trackers and peers are known at this point,
+// so the returned torrent is flagged with `MissingMetadata`.
+func NewTorrentFromMagnet(uri string) (*Torrent, error) {
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Torrent{
+		Name:            m.DisplayName,
+		InfoHash:        m.InfoHash,
+		InfoHashV2:      m.InfoHashV2,
+		HasV1:           m.HasV1,
+		HasV2:           m.HasV2,
+		WebSeeds:        m.WebSeeds,
+		DirectPeers:     m.Peers,
+		SelectedFiles:   m.SelectOnly,
+		MissingMetadata: true,
+		PeerId:          PeerID,
+		Port:            Port,
+	}
+
+	// Each `tr` gets its own tier so they are tried in the given order
+	for _, tr := range m.Trackers {
+		t.AnnounceList = append(t.AnnounceList, []string{tr})
+	}
+	if len(m.Trackers) > 0 {
+		t.Announce = m.Trackers[0]
+	}
+
+	return t, nil
+}
+
+// Visualize information about the torrent.
+// (e.g. announce URL, file name, size, piece length, number of pieces, info hash)
+func (t *Torrent) ViewTorrent() {
+	var displaySize string
+
+	// Format the size in GB, MB, or KB
+	if s := t.Length / (1024 * 1024); s >= 1024 {
+		displaySize = fmt.Sprintf("%.2f GB", float64(s)/1024)
+	} else if s >= 1 {
+		displaySize = fmt.Sprintf("%.2f MB", float64(s))
+	} else {
+		displaySize = fmt.Sprintf("%d KB", t.Length/1024)
+	}
+
+	line := strings.Repeat("#", 70)
+
+	fmt.Println()
+	fmt.Println(line)
+	fmt.Printf("\nAnnounce: %s\n", t.Announce)
+	if len(t.AnnounceList) > 1 {
+		fmt.Printf("Tracker tiers: %d\n", len(t.AnnounceList))
+	}
+
+	if t.MissingMetadata {
+		fmt.Printf("Name: %s\n", t.Name)
+		fmt.Printf("Trackers: %d\n", len(t.AnnounceList))
+		fmt.Printf("Peers: %d\n", len(t.DirectPeers))
+		if t.HasV1 {
+			fmt.Printf("Info Hash: %x\n", t.InfoHash)
+		}
+		if t.HasV2 {
+			fmt.Printf("Info Hash (v2): %x\n", t.InfoHashV2)
+		}
+		fmt.Println("Metadata: not yet fetched")
+		fmt.Println()
+		fmt.Println(line)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("File name: %s\n", t.Name)
+	fmt.Printf("File size: %s\n", displaySize)
+	fmt.Printf("Piece length: %d KB\n", t.PieceLength/1024)
+	if t.HasV1 {
+		fmt.Printf("Number of pieces: %d\n", len(t.PieceHashes))
+	}
+	fmt.Printf("Version: %s\n", t.versionString())
+	fmt.Printf("Private: %t\n", t.Private)
+	if t.HasV1 {
+		fmt.Printf("Info Hash: %x\n", t.InfoHash)
+	}
+	if t.HasV2 {
+		fmt.Printf("Info Hash (v2): %x\n", t.InfoHashV2)
+	}
+
+	if len(t.Files) > 1 {
+		fmt.Printf("Files (%d):\n", len(t.Files))
+		for _, f := range t.Files {
+			if f.IsPadding() {
+				continue
+			}
+
+			switch {
+			case f.IsSymlink():
+				fmt.Printf("  %s -> %s\n", f.Path, f.SymlinkPath)
+			case f.Attr != "":
+				fmt.Printf("  %s (%d bytes) [%s]\n", f.Path, f.Length, f.Attr)
+			default:
+				fmt.Printf("  %s (%d bytes)\n", f.Path, f.Length)
+			}
+		}
+	}
+	fmt.Println()
+	fmt.Println(line)
+	fmt.Println()
+}
+
+// Describes which metadata versions the torrent carries.
+func (t *Torrent) versionString() string {
+	switch {
+	case t.HasV1 && t.HasV2:
+		return "hybrid (v1 + v2)"
+	case t.HasV2:
+		return "v2"
+	default:
+		return "v1"
+	}
+}
+
+func (t *Torrent) StartDownload() {
+	if t.MissingMetadata {
+		if err := t.FetchMetadata(); err != nil {
+			fmt.Println("cannot start download:", err)
+			return
+		}
+		t.ViewTorrent()
+	}
+
+	store, err := t.store()
+	if err != nil {
+		fmt.Println("cannot start download:", err)
+		return
+	}
+
+	// Join every swarm the torrent belongs to (v1, v2 or both)
+	var wg sync.WaitGroup
+
+	for _, ih := range t.swarmHashes() {
+		pm := peers.NewPeerManager(nil, ih[:], []byte(t.PeerId))
+		pm.Port = t.Port
+		pm.OnUpload = t.AddUploaded
+		pm.PEX = t.PEXAllowed()
+		if store != nil {
+			pm.Store = store
+		}
+		t.useDHT(pm)
+
+		d := NewDiscovery(func(pArr []peers.Peer) {
+			go pm.Connect(pArr)
+		})
+		for _, src := range t.peerSources(ih) {
+			d.Add(src)
+		}
+
+		// Without any source there is nobody to connect to
+		if d.Len() == 0 {
+			continue
+		}
+
+		// Running low on peers, ask for more
+		pm.OnPeerLost = func(connected int) {
+			if connected < minConnectedPeers {
+				d.RequestPeers()
+			}
+		}
+
+		if !t.register(d, pm) {
+			d.Stop()
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pm.HandlePeers()
+		}()
+		d.Start()
+	}
+
+	wg.Wait()
+}
+
+// The store pieces are downloaded into, nil if we cannot verify them.
+func (t *Torrent) store() (*downloader, error) {
+	if len(t.PieceHashes) == 0 && t.Length > 0 {
+		fmt.Println("Downloading v2-only torrents is not supported yet, only looking for peers")
+		return nil, nil
+	}
+
+	dir := t.DownloadDir
+	if dir == "" {
+		dir = "."
+	}
+	return t.newDownloader(dir)
+}
+
+// The peer sources of the swarm of the given info hash.
+func (t *Torrent) peerSources(infoHash hash) []PeerSource {
+	sources := []PeerSource{}
+
+	if len(t.AnnounceList) > 0 {
+		sources = append(sources, t.newAnnouncer(infoHash))
+	}
+
+	// Private torrents only ever use the peers handed out by their trackers
+	if t.untrackedPeersAllowed() && len(t.DirectPeers) > 0 {
+		sources = append(sources, NewStaticSource(t.directPeers()))
+	}
+
+	if t.DHT != nil && t.DHTAllowed() {
+		sources = append(sources, t.newDHTSource(infoHash))
+	}
+
+	if t.LSD != nil && t.LSDAllowed() {
+		sources = append(sources, t.newLSDSource(infoHash))
+	}
+	return sources
+}
+
+// Keep track of what a download is running so Stop can shut it down.
+// Returns false if the torrent was already stopped.
+func (t *Torrent) register(d *Discovery, pm *peers.PeerManager) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return false
+	}
+	t.discoveries = append(t.discoveries, d)
+	t.managers = append(t.managers, pm)
+	return true
+}
+
+// Stop disconnects from every peer and tells the trackers we are leaving.
+// It blocks until the `stopped` events have been sent.
+func (t *Torrent) Stop() {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return
+	}
+	t.stopped = true
+	discoveries, managers := t.discoveries, t.managers
+	t.mu.Unlock()
+
+	for _, pm := range managers {
+		pm.Close()
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range discoveries {
+		wg.Add(1)
+		go func(d *Discovery) {
+			defer wg.Done()
+			d.Stop()
+		}(d)
+	}
+	wg.Wait()
+}
+
+// Takes a path as an argument and checks if the file is a .torrent file.
+// Then reads the file and a pointer to the file.
+func parseTorrentFromPath(path string) (*os.File, error) {
+	f, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Check the extension
+	if strings.Split(f.Name(), ".")[1] != "torrent" {
+		return nil, errors.New("file " + f.Name() + " is not a .torrent file")
+	}
+
+	return os.Open(path)
+}
+
+// Takes a file as argument and reads the torrent metadata from it.
+// Returns a Torrent struct with the metadata.
+func metaFromFile(f *os.File) (*Torrent, error) {
+	if f == nil {
+		return nil, errors.New("file pointer is nil")
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, errors.New("failed to read torrent file: " + err.Error())
+	}
+
+	bt := bcodeTorrent{}
+	if err := unmarshalLenient(data, &bt); err != nil {
+		return nil, errors.New("failed to parse torrent file: " + err.Error())
+	}
+
+	if len(bt.Info) == 0 || bt.Info[0] != 'd' {
+		return nil, errors.New("failed to parse torrent file: missing info dictionary")
+	}
+
+	t := &Torrent{
+		Announce:     bt.Announce,
+		AnnounceList: buildTiers(bt.Announce, bt.AnnounceList),
+		Nodes:        parseNodes(bt.Nodes),
+		PeerId:       PeerID,
+		Port:         Port,
+	}
+
+	if err := t.setInfo(bt.Info); err != nil {
+		return nil, err
+	}
+
+	if t.HasV2 {
+		if err := t.setPieceLayers(bt.PieceLayers); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Decode the bencoded `info` dictionary and fill in the fields derived from it.
+// The info hash is the SHA1 hash of the exact bytes passed in.
+func (t *Torrent) setInfo(rawInfo []byte) error {
+	info := bcodeInfo{}
+	if err := unmarshalLenient(rawInfo, &info); err != nil {
+		return errors.New("failed to parse info dictionary: " + err.Error())
+	}
+
+	if info.MetaVersion != 0 && info.MetaVersion != metaVersion2 {
+		return fmt.Errorf("unsupported meta version: %d", info.MetaVersion)
+	}
+
+	hasV2 := info.MetaVersion == metaVersion2
+	hasV1 := !hasV2 || info.Pieces != ""
+
+	var (
+		pHashes []hash
+		files   []File
+		err     error
+	)
+
+	if hasV1 {
+		// Split the pieces into an array of  hashes
+		if pHashes, err = info.splitPieceHashes(); err != nil {
+			return err
+		}
+
+		if files, err = info.fileTable(); err != nil {
+			return err
+		}
+	}
+
+	if hasV2 {
+		if err := validateV2PieceLength(info.PieceLength); err != nil {
+			return err
+		}
+
+		v2Files, err := parseFileTree(rawInfo, info.PieceLength)
+		if err != nil {
+			return err
+		}
+
+		// Hybrid torrents keep the v1 file table, which includes padding
+		if hasV1 {
+			if err := attachPiecesRoots(files, v2Files); err != nil {
+				return err
+			}
+		} else {
+			files = v2Files
+		}
+	}
+
+	singleFile := len(info.Files) == 0
+	if !hasV1 {
+		singleFile = len(files) == 1 && files[0].Path == info.Name
+	}
+
+	length := 0
+	for _, f := range files {
+		length += f.Length
+	}
+
+	if hasV1 {
+		t.InfoHash = sha1.Sum(rawInfo)
+	}
+	if hasV2 {
+		t.InfoHashV2 = sha256.Sum256(rawInfo)
+	}
+	t.HasV1 = hasV1
+	t.HasV2 = hasV2
+	t.PieceHashes = pHashes
+	t.PieceLength = info.PieceLength
+	t.Length = length
+	t.Files = files
+	t.Name = info.Name
+	t.Private = info.Private == 1
+	t.MissingMetadata = false
+	t.infoBytes = rawInfo
+	t.singleFile = singleFile
+
+	return nil
+}
+
+// Take the `info` key from meta and split the pieces into an array of hashes.
+// Returns an array of 20-byte hashes.
+func (i bcodeInfo) splitPieceHashes() ([]hash, error) {
+	hashLen := 20 // SHA1 is 20 bytes long
+
+	if len(i.Pieces)%hashLen != 0 {
+		return nil, errors.New("malformed pieces: " + fmt.Sprint(len(i.Pieces)))
+	}
+
+	numHashes := len(i.Pieces) / hashLen
+	length := i.totalLength()
+	expectedNumHashes := int(math.Ceil(float64(length) / float64(i.PieceLength)))
+
+	if numHashes != expectedNumHashes {
+		return nil, fmt.Errorf("piece count mismatch: got %d hashes, expected %d (total size=%d, piece size=%d)",
+			numHashes, expectedNumHashes, length, i.PieceLength)
+	}
+
+	hashes := make([]hash, numHashes)
+
+	for idx := 0; idx < numHashes; idx++ {
+		copy(hashes[idx][:], i.Pieces[idx*hashLen:(idx+1)*hashLen])
+	}
+	return hashes, nil
+}
+
+// Total length of the torrent data in bytes.
+// For multi-file torrents this is the sum of all file lengths.
+func (i bcodeInfo) totalLength() int {
+	if len(i.Files) == 0 {
+		return i.Length
+	}
+
+	total := 0
+	for _, f := range i.Files {
+		total += f.Length
+	}
+	return total
+}
+
+// Build the file table from the `info` dictionary.
+// Each file gets its byte offset within the concatenated torrent data.
+func (i bcodeInfo) fileTable() ([]File, error) {
+	if len(i.Files) == 0 {
+		f := File{Path: i.Name, Length: i.Length, Attr: i.Attr}
+		if err := f.setSymlinkPath(i.SymlinkPath); err != nil {
+			return nil, err
+		}
+		return []File{f}, nil
+	}
+
+	files := make([]File, 0, len(i.Files))
+	offset := 0
+
+	for idx, f := range i.Files {
+		if f.Length < 0 {
+			return nil, fmt.Errorf("file %d has negative length: %d", idx, f.Length)
+		}
+
+		if len(f.Path) == 0 {
+			return nil, fmt.Errorf("file %d has an empty path", idx)
+		}
+
+		for _, c := range f.Path {
+			if !validPathComponent(c) {
+				return nil, fmt.Errorf("file %d has an invalid path component: %q", idx, c)
+			}
+		}
+
+		file := File{
+			Path:   filepath.Join(f.Path...),
+			Length: f.Length,
+			Offset: offset,
+			Attr:   f.Attr,
+		}
+		if err := file.setSymlinkPath(f.SymlinkPath); err != nil {
+			return nil, err
+		}
+
+		files = append(files, file)
+		offset += f.Length
+	}
+	return files, nil
+}
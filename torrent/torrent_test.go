@@ -0,0 +1,199 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/AcidOP/torrly/bencode"
+)
+
+// Write a .torrent file made of `top` with `info` as its info dictionary.
+// Returns its path and the info dictionary exactly as written.
+func writeTestTorrent(t *testing.T, top, info map[string]any) (string, []byte) {
+	t.Helper()
+
+	rawInfo, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	top["info"] = bencode.RawMessage(rawInfo)
+	data, err := bencode.Marshal(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, rawInfo
+}
+
+func TestTorrentFileRoundTrip(t *testing.T) {
+	pieces := strings.Repeat("0123456789abcdefghij", 3)
+
+	tests := []struct {
+		name    string
+		top     map[string]any
+		info    map[string]any
+		private bool
+		files   []string
+	}{
+		{
+			name: "single file with md5sum",
+			top: map[string]any{
+				"announce":      "http://tracker.example.com/announce",
+				"comment":       "Ubuntu CD releases.ubuntu.com",
+				"created by":    "mktorrent 1.1",
+				"creation date": 1700000000,
+			},
+			info: map[string]any{
+				"name":         "ubuntu.iso",
+				"length":       40000,
+				"piece length": 16384,
+				"pieces":       pieces,
+				"md5sum":       "d41d8cd98f00b204e9800998ecf8427e",
+			},
+			files: []string{"ubuntu.iso"},
+		},
+		{
+			name: "private with source",
+			top: map[string]any{
+				"announce":      "https://tracker.example.org/a1b2c3/announce",
+				"announce-list": []any{[]any{"https://tracker.example.org/a1b2c3/announce"}},
+				"encoding":      "UTF-8",
+			},
+			info: map[string]any{
+				"name":         "album",
+				"piece length": 32768,
+				"pieces":       pieces[:40],
+				"private":      1,
+				"source":       "EXAMPLE",
+				"files": []any{
+					map[string]any{"length": 30000, "path": []any{"01 - intro.flac"}, "md5sum": "0123456789abcdef0123456789abcdef"},
+					map[string]any{"length": 20000, "path": []any{"cover.jpg"}},
+				},
+			},
+			private: true,
+			files:   []string{"01 - intro.flac", "cover.jpg"},
+		},
+		{
+			name: "unknown keys",
+			top: map[string]any{
+				"announce":      "udp://tracker.example.net:6969/announce",
+				"publisher-url": "https://example.net/",
+				"x-custom":      map[string]any{"a": []any{1, "b"}},
+				"url-list":      []any{"https://mirror.example.net/"},
+			},
+			info: map[string]any{
+				"name":         "dataset",
+				"piece length": 16384,
+				"pieces":       pieces,
+				"x-info-extra": "kept in the info hash",
+				"files": []any{
+					map[string]any{"length": 40000, "path": []any{"sub", "part1.csv"}, "x-file-key": 7},
+				},
+			},
+			files: []string{"sub/part1.csv"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, rawInfo := writeTestTorrent(t, tt.top, tt.info)
+			wantHash := sha1.Sum(rawInfo)
+
+			tor, err := NewTorrentFromFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(tor.InfoHash[:], wantHash[:]) {
+				t.Errorf("info hash = %x, want %x", tor.InfoHash, wantHash)
+			}
+			if tor.Private != tt.private {
+				t.Errorf("private = %v, want %v", tor.Private, tt.private)
+			}
+
+			paths := []string{}
+			for _, f := range tor.Files {
+				paths = append(paths, filepath.ToSlash(f.Path))
+			}
+			if !slices.Equal(paths, tt.files) {
+				t.Errorf("files = %q, want %q", paths, tt.files)
+			}
+
+			// Writing the torrent back out keeps the info dictionary byte for byte
+			out := filepath.Join(t.TempDir(), "out.torrent")
+			if err := tor.WriteTorrentFile(out); err != nil {
+				t.Fatal(err)
+			}
+
+			again, err := NewTorrentFromFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.InfoHash != tor.InfoHash {
+				t.Errorf("info hash after round trip = %x, want %x", again.InfoHash, tor.InfoHash)
+			}
+			if !bytes.Equal(again.infoBytes, rawInfo) {
+				t.Error("info dictionary changed in the round trip")
+			}
+			if again.Private != tor.Private || again.Length != tor.Length || len(again.PieceHashes) != len(tor.PieceHashes) {
+				t.Errorf("round trip = %+v, want %+v", again, tor)
+			}
+			if !slices.EqualFunc(again.AnnounceList, tor.AnnounceList, slices.Equal) {
+				t.Errorf("announce list after round trip = %q, want %q", again.AnnounceList, tor.AnnounceList)
+			}
+		})
+	}
+}
+
+func TestTorrentFileUnsortedKeys(t *testing.T) {
+	// Keys out of order in both dictionaries, as some old clients wrote them
+	rawInfo := "d4:name4:test12:piece lengthi16384e6:lengthi100e6:pieces20:" + strings.Repeat("x", 20) + "e"
+	data := "d8:announce19:http://t.example/an4:info" + rawInfo + "7:comment2:hie"
+
+	path := filepath.Join(t.TempDir(), "unsorted.torrent")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tor, err := NewTorrentFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The info hash is still that of the bytes as found in the file
+	if want := sha1.Sum([]byte(rawInfo)); tor.InfoHash != want {
+		t.Errorf("info hash = %x, want %x", tor.InfoHash, want)
+	}
+	if tor.Name != "test" || tor.Length != 100 {
+		t.Errorf("name = %q, length = %d, want test and 100", tor.Name, tor.Length)
+	}
+}
+
+func TestTorrentFileDuplicateInfo(t *testing.T) {
+	info := func(name string) string {
+		return "d6:lengthi100e4:name" + strconv.Itoa(len(name)) + ":" + name + "12:piece lengthi16384e6:pieces20:" + strings.Repeat("x", 20) + "e"
+	}
+
+	// A second `info` further down must not replace the one that is hashed
+	data := "d4:info" + info("first") + "8:announce19:http://t.example/an4:info" + info("second") + "e"
+
+	path := filepath.Join(t.TempDir(), "duplicate.torrent")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if tor, err := NewTorrentFromFile(path); err == nil {
+		t.Errorf("torrent with two info dictionaries was accepted, named %q", tor.Name)
+	}
+}
@@ -1,113 +1,425 @@
-package torrent
-
-import (
-	"bytes"
-	"errors"
-	"fmt"
-	"io"
-	"net"
-	"net/http"
-	"net/url"
-	"strconv"
-
-	"github.com/AcidOP/torrly/peers"
-	"github.com/jackpal/bencode-go"
-)
-
-type peer struct {
-	IP     string `bencode:"ip"`
-	Port   int    `bencode:"port"`
-	PeerId string `bencode:"peer id"`
-}
-
-type TrackerResponse struct {
-	Interval   int    `bencode:"interval"`
-	Peers      []peer `bencode:"peers"`
-	Completed  int    `bencode:"complete"`
-	Incomplete int    `bencode:"incomplete"`
-}
-
-func (tr TrackerResponse) Show() {
-	fmt.Println("📡 Tracker Response:")
-	fmt.Println()
-	fmt.Println("  ⏱ Interval:", tr.Interval)
-	fmt.Println("  👥 Peers: ", len(tr.Peers))
-
-	if tr.Completed > 0 || tr.Incomplete > 0 {
-		fmt.Println("  📊 Swarm Stats:")
-		if tr.Completed > 0 {
-			fmt.Println("    ✅ Seeders (complete):", tr.Completed)
-		}
-		if tr.Incomplete > 0 {
-			fmt.Println("    🔄 Leechers (incomplete):", tr.Incomplete)
-		}
-	}
-	fmt.Println()
-}
-
-// Create a URL to request to the tracker for peer information
-// Must be a GET request with the following:
-// https://wiki.theory.org/BitTorrentSpecification#Tracker_Request_Parameters
-func (t Torrent) buildTrackerURL() (string, error) {
-	base, err := url.Parse(t.Announce)
-	if err != nil {
-		return "", err
-	}
-
-	params := url.Values{
-		"info_hash":  {string(t.InfoHash[:])},
-		"peer_id":    {t.PeerId},
-		"port":       {strconv.Itoa(t.Port)},
-		"uploaded":   {"0"},
-		"downloaded": {"0"},
-		"left":       {strconv.Itoa(t.Length)},
-	}
-
-	base.RawQuery = params.Encode()
-	return base.String(), nil
-}
-
-// Announce to the tracker to get a list of peers
-// Returns a map of peers with their IP addresses and ports
-func (t *Torrent) getTrackerResponse() ([]byte, error) {
-	trackerURL, err := t.buildTrackerURL()
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := http.Get(trackerURL)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.New("failed to read tracker response: " + err.Error())
-	}
-	return data, nil
-}
-
-// Returns a list of peers from the tracker
-func (t Torrent) GetAvailablePeers() ([]peers.Peer, error) {
-	res, err := t.getTrackerResponse()
-	if err != nil {
-		return nil, err
-	}
-
-	tr := TrackerResponse{}
-	if err = bencode.Unmarshal(bytes.NewReader(res), &tr); err != nil {
-		return nil, err
-	}
-
-	tr.Show()
-
-	pArr := []peers.Peer{}
-	for _, p := range tr.Peers {
-		pArr = append(pArr, peers.Peer{
-			IP:   net.ParseIP(p.IP),
-			Port: p.Port,
-		})
-	}
-	return pArr, nil
-}
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/AcidOP/torrly/bencode"
+	"github.com/AcidOP/torrly/peers"
+)
+
+type peer struct {
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+	PeerId string `bencode:"peer id"`
+}
+
+// Peers of a tracker response, sent either as a list of dictionaries
+// or as a compact string of 6 bytes per peer (BEP 23).
+type peerList []peer
+
+// IPv6 peers of a tracker response (BEP 7), compact with 18 bytes per peer.
+type peerList6 []peer
+
+type TrackerResponse struct {
+	FailureReason  string    `bencode:"failure reason"`  // Set instead of everything else when the announce failed
+	WarningMessage string    `bencode:"warning message"` // The announce worked, but the tracker has something to say
+	RetryIn        retryIn   `bencode:"retry in"`        // Minutes to wait before retrying a failed announce (BEP 31)
+	Interval       int       `bencode:"interval"`
+	MinInterval    int       `bencode:"min interval"`
+	Peers          peerList  `bencode:"peers"`
+	Peers6         peerList6 `bencode:"peers6"`
+	Completed      int       `bencode:"complete"`
+	Incomplete     int       `bencode:"incomplete"`
+	TrackerID      string    `bencode:"tracker id"`  // To be sent back on later announces
+	ExternalIP     []byte    `bencode:"external ip"` // Our address as seen by the tracker (BEP 24)
+}
+
+// TrackerError is an announce rejected by the tracker, either with an
+// HTTP error status or with a `failure reason`.
+type TrackerError struct {
+	URL        string // Announce URL of the tracker
+	StatusCode int    // HTTP status code, 0 for UDP trackers
+	Reason     string // `failure reason` sent by the tracker, if any
+	RetryIn    int    // Minutes to wait before retrying (BEP 31), 0 if not given
+	Never      bool   // The tracker asked never to be retried
+}
+
+func (e *TrackerError) Error() string {
+	switch {
+	case e.StatusCode != 0 && e.Reason != "":
+		return fmt.Sprintf("status %d: %s", e.StatusCode, e.Reason)
+	case e.StatusCode != 0:
+		return fmt.Sprintf("status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	default:
+		return "failure reason: " + e.Reason
+	}
+}
+
+// The `retry in` key of a failure response (BEP 31).
+// Either a number of minutes or the string "never".
+// https://www.bittorrent.org/beps/bep_0031.html
+type retryIn struct {
+	Minutes int
+	Never   bool
+}
+
+func (r *retryIn) UnmarshalBencode(data []byte) error {
+	if len(data) > 0 && data[0] == 'i' {
+		return bencode.Unmarshal(data, &r.Minutes)
+	}
+
+	var s string
+	if err := bencode.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s != "never" {
+		return fmt.Errorf("invalid retry in %q", s)
+	}
+	r.Never = true
+	return nil
+}
+
+// Size of a compact peer: address + 2 bytes port.
+const (
+	compactPeerLen  = 6
+	compactPeer6Len = 18
+)
+
+func (pl *peerList) UnmarshalBencode(data []byte) error {
+	if len(data) > 0 && data[0] == 'l' {
+		d := bencode.NewDecoder(bytes.NewReader(data))
+		d.AllowUnsortedKeys()
+		return d.Decode((*[]peer)(pl))
+	}
+
+	var compact []byte
+	if err := bencode.Unmarshal(data, &compact); err != nil {
+		return err
+	}
+	return pl.parseCompact(compact, compactPeerLen)
+}
+
+func (pl *peerList6) UnmarshalBencode(data []byte) error {
+	var compact []byte
+	if err := bencode.Unmarshal(data, &compact); err != nil {
+		return err
+	}
+	return (*peerList)(pl).parseCompact(compact, compactPeer6Len)
+}
+
+// Parse the compact peer format (BEP 23), with 4 or 16 byte addresses.
+// Compact peers carry no peer ID.
+// https://www.bittorrent.org/beps/bep_0023.html
+func (pl *peerList) parseCompact(compact []byte, peerLen int) error {
+	if len(compact)%peerLen != 0 {
+		return fmt.Errorf("malformed compact peers: %d bytes", len(compact))
+	}
+
+	ipLen := peerLen - 2
+	*pl = make(peerList, 0, len(compact)/peerLen)
+	for i := 0; i < len(compact); i += peerLen {
+		*pl = append(*pl, peer{
+			IP:   net.IP(compact[i : i+ipLen]).String(),
+			Port: int(binary.BigEndian.Uint16(compact[i+ipLen : i+peerLen])),
+		})
+	}
+	return nil
+}
+
+func (tr TrackerResponse) Show() {
+	fmt.Println("📡 Tracker Response:")
+	fmt.Println()
+	fmt.Println("  ⏱ Interval:", tr.Interval)
+	fmt.Println("  👥 Peers: ", len(tr.Peers)+len(tr.Peers6))
+
+	if tr.WarningMessage != "" {
+		fmt.Println("  ⚠️ Warning:", tr.WarningMessage)
+	}
+
+	if tr.Completed > 0 || tr.Incomplete > 0 {
+		fmt.Println("  📊 Swarm Stats:")
+		if tr.Completed > 0 {
+			fmt.Println("    ✅ Seeders (complete):", tr.Completed)
+		}
+		if tr.Incomplete > 0 {
+			fmt.Println("    🔄 Leechers (incomplete):", tr.Incomplete)
+		}
+	}
+	fmt.Println()
+}
+
+// Announce events sent to trackers. Regular announces have no event.
+const (
+	eventNone      = ""
+	eventStarted   = "started"
+	eventCompleted = "completed"
+	eventStopped   = "stopped"
+)
+
+// Create a URL to request to the tracker for peer information
+// Must be a GET request with the following:
+// https://wiki.theory.org/BitTorrentSpecification#Tracker_Request_Parameters
+func (t *Torrent) buildTrackerURL(announce string, infoHash hash, event string) (string, error) {
+	base, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+
+	// Keep the tracker's own parameters, e.g. a passkey
+	params := base.Query()
+	params.Set("info_hash", string(infoHash[:]))
+	params.Set("peer_id", t.PeerId)
+	params.Set("port", strconv.Itoa(t.Port))
+	params.Set("uploaded", strconv.FormatInt(t.Uploaded(), 10))
+	params.Set("downloaded", strconv.FormatInt(t.Downloaded(), 10))
+	params.Set("left", strconv.FormatInt(t.Left(), 10))
+	if t.NoCompact {
+		params.Set("compact", "0")
+	} else {
+		params.Set("compact", "1")
+	}
+	// Peer IDs in a dictionary peer list are never used, they come with the handshake
+	params.Set("no_peer_id", "1")
+	params.Set("key", fmt.Sprintf("%08x", t.announceKey()))
+
+	if event != eventNone {
+		params.Set("event", event)
+	}
+	if t.NumWant > 0 {
+		params.Set("numwant", strconv.Itoa(t.NumWant))
+	}
+	if t.AnnounceIP != "" {
+		params.Set("ip", t.AnnounceIP)
+	}
+	if id := t.trackerID(announce); id != "" {
+		params.Set("trackerid", id)
+	}
+
+	// Let the tracker know our address in the other family too (BEP 7)
+	ipv4, ipv6 := localAddrs()
+	if ipv4 != nil {
+		params.Set("ipv4", ipv4.String())
+	}
+	if ipv6 != nil {
+		params.Set("ipv6", ipv6.String())
+	}
+
+	base.RawQuery = params.Encode()
+	return base.String(), nil
+}
+
+// Announce to the tracker to get a list of peers
+// Returns the raw bencoded tracker response, or a *TrackerError
+// carrying the failure reason if the tracker answered with an error status.
+// `family` is "4" or "6" to connect over a single address family, or empty.
+func (t *Torrent) getTrackerResponse(announce string, infoHash hash, event, family string) ([]byte, error) {
+	client := trackerClient()
+
+	trackerURL, err := t.buildTrackerURL(client.rewrite(announce), infoHash, event)
+	if err != nil {
+		return nil, err
+	}
+
+	status, data, err := client.get(trackerURL, family)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		te := &TrackerError{URL: announce, StatusCode: status}
+
+		// Error pages are often bencoded failures, but don't count on it
+		if tr, err := decodeTrackerResponse(data); err == nil {
+			te.Reason = tr.FailureReason
+			te.RetryIn, te.Never = tr.RetryIn.Minutes, tr.RetryIn.Never
+		}
+		return nil, te
+	}
+	return data, nil
+}
+
+// Announce to a single tracker, over HTTP or UDP depending on the URL.
+// Trackers reachable over both IPv4 and IPv6 are announced to over both,
+// so they can hand our addresses in both families to other peers.
+func (t *Torrent) announce(announce string, infoHash hash, event string) (*TrackerResponse, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	families := addressFamilies(u.Hostname())
+	if len(families) == 1 {
+		return t.announceOver(u, announce, infoHash, event, families[0])
+	}
+
+	var (
+		wg      sync.WaitGroup
+		results = make([]*TrackerResponse, len(families))
+		errs    = make([]error, len(families))
+	)
+
+	for i, family := range families {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = t.announceOver(u, announce, infoHash, event, family)
+		}()
+	}
+	wg.Wait()
+
+	ok := slices.DeleteFunc(results, func(tr *TrackerResponse) bool { return tr == nil })
+	if len(ok) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return mergeResponses(ok...), nil
+}
+
+// Announce to a tracker over the given address family ("4", "6" or either).
+func (t *Torrent) announceOver(u *url.URL, announce string, infoHash hash, event, family string) (*TrackerResponse, error) {
+	switch u.Scheme {
+	case "udp":
+		tr, err := t.announceUDP("udp"+family, u.Host, infoHash, event)
+
+		var ue *UDPTrackerError
+		if errors.As(err, &ue) {
+			return nil, &TrackerError{URL: announce, Reason: ue.Message}
+		}
+		return tr, err
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+
+	res, err := t.getTrackerResponse(announce, infoHash, event, family)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := decodeTrackerResponse(res)
+	if err != nil {
+		return nil, err
+	}
+
+	if tr.FailureReason != "" {
+		return nil, &TrackerError{
+			URL:     announce,
+			Reason:  tr.FailureReason,
+			RetryIn: tr.RetryIn.Minutes,
+			Never:   tr.RetryIn.Never,
+		}
+	}
+
+	if len(tr.ExternalIP) == net.IPv4len || len(tr.ExternalIP) == net.IPv6len {
+		peers.SetExternalIP(net.IP(tr.ExternalIP))
+	}
+	return tr, nil
+}
+
+func decodeTrackerResponse(data []byte) (*TrackerResponse, error) {
+	tr := TrackerResponse{}
+	if err := unmarshalLenient(data, &tr); err != nil {
+		return nil, err
+	}
+	return &tr, nil
+}
+
+// Decode bencoded data written by other clients and trackers, not all of
+// which sort their dictionary keys. Info hashes are computed over the raw
+// bytes, so accepting unsorted keys doesn't change them.
+func unmarshalLenient(data []byte, v any) error {
+	d := bencode.NewDecoder(bytes.NewReader(data))
+	d.AllowUnsortedKeys()
+	return d.Decode(v)
+}
+
+// Announce to a UDP tracker (BEP 15).
+func (t *Torrent) announceUDP(network, addr string, infoHash hash, event string) (*TrackerResponse, error) {
+	req := UDPAnnounce{
+		InfoHash:   infoHash,
+		Downloaded: t.Downloaded(),
+		Left:       t.Left(),
+		Uploaded:   t.Uploaded(),
+		Event:      udpEvent(event),
+		Key:        t.announceKey(),
+		NumWant:    -1,
+		Port:       uint16(t.Port),
+	}
+	copy(req.PeerID[:], t.PeerId)
+
+	if t.NumWant > 0 {
+		req.NumWant = int32(t.NumWant)
+	}
+	if ip := net.ParseIP(t.AnnounceIP).To4(); ip != nil {
+		req.IP = binary.BigEndian.Uint32(ip)
+	}
+
+	limit := udpRequestDeadline
+	if event == eventStopped {
+		limit = udpStoppedDeadline
+	}
+	return udpTrackerFor(network, addr).announce(req, limit)
+}
+
+// Returns a list of peers from the trackers.
+// For hybrid torrents these are the peers of the v1 swarm.
+func (t *Torrent) GetAvailablePeers() ([]peers.Peer, error) {
+	hashes := t.swarmHashes()
+	if len(hashes) == 0 {
+		return nil, errors.New("torrent has no info hash")
+	}
+
+	tr, err := t.announceSwarm(hashes[0], eventNone)
+	if err != nil {
+		return nil, err
+	}
+	return tr.peers(), nil
+}
+
+// Announce to the trackers of the swarm of the given info hash.
+func (t *Torrent) announceSwarm(infoHash hash, event string) (*TrackerResponse, error) {
+	if len(t.AnnounceList) == 0 {
+		return nil, errors.New("torrent has no trackers")
+	}
+
+	if t.AnnounceAll {
+		return t.announceAllTiers(infoHash, event)
+	}
+	return t.announceTiers(infoHash, event)
+}
+
+// Convert the peers of a tracker response into peers we can dial.
+func (tr *TrackerResponse) peers() []peers.Peer {
+	pArr := []peers.Peer{}
+	for _, p := range slices.Concat(tr.Peers, peerList(tr.Peers6)) {
+		ip := net.ParseIP(p.IP)
+		if ip == nil {
+			fmt.Printf("Skipping peer with invalid IP %q\n", p.IP)
+			continue
+		}
+
+		pArr = append(pArr, peers.Peer{
+			IP:   ip,
+			Port: p.Port,
+			ID:   []byte(p.PeerId),
+		})
+	}
+	return pArr
+}
+
+// Random key sent with every announce, so trackers can recognise us
+// when our IP address changes.
+func (t *Torrent) announceKey() uint32 {
+	t.keyOnce.Do(func() {
+		t.key, _ = randomUint32()
+	})
+	return t.key
+}
@@ -0,0 +1,203 @@
+package torrent
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUserAgent      = "torrly/0.1"
+	defaultTrackerTimeout = 30 * time.Second
+
+	// Announce and scrape responses are a few kilobytes at most,
+	// anything past this is a broken or hostile tracker
+	maxTrackerResponse = 4 << 20
+)
+
+// TrackerClientConfig configures how we talk to HTTP trackers.
+type TrackerClientConfig struct {
+	Timeout   time.Duration // Timeout of a whole request, 0 uses 30 seconds
+	Proxy     string        // http://, https:// or socks5:// proxy URL, empty uses the environment
+	CAFile    string        // PEM file of extra CAs to trust, e.g. for a self-signed tracker
+	UserAgent string        // Empty uses DefaultUserAgent
+
+	Headers  map[string]http.Header    // Extra headers, keyed by tracker host
+	Cookies  map[string][]*http.Cookie // Cookies, keyed by tracker host
+	Rewrites []RewriteRule             // Applied in order to every tracker URL
+}
+
+// RewriteRule replaces text in the URLs of matching trackers,
+// e.g. a {passkey} placeholder with the user's passkey.
+type RewriteRule struct {
+	Host string // Tracker host the rule applies to, empty for every tracker
+	Old  string
+	New  string
+}
+
+// TrackerClient is the HTTP client used for announces and scrapes.
+type TrackerClient struct {
+	cfg     TrackerClientConfig
+	clients map[string]*http.Client // Keyed by address family: "", "4" or "6"
+}
+
+func NewTrackerClient(cfg TrackerClientConfig) (*TrackerClient, error) {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTrackerTimeout
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = DefaultUserAgent
+	}
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+
+	// We ask for gzip ourselves so responses are decoded the same way
+	// whether or not the tracker honoured the request
+	base.DisableCompression = true
+
+	if cfg.Proxy != "" {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %v", cfg.Proxy, err)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+		}
+		base.Proxy = http.ProxyURL(proxy)
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		base.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	c := &TrackerClient{cfg: cfg, clients: map[string]*http.Client{}}
+	for _, family := range []string{"", "4", "6"} {
+		transport := base.Clone()
+		if family != "" {
+			dialer := &net.Dialer{}
+			network := "tcp" + family
+			transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			}
+		}
+		c.clients[family] = &http.Client{Transport: transport, Timeout: cfg.Timeout}
+	}
+	return c, nil
+}
+
+var (
+	trackerHTTPMu sync.Mutex
+	trackerHTTP   *TrackerClient
+)
+
+// SetTrackerClient makes every torrent use `c` for HTTP trackers.
+func SetTrackerClient(c *TrackerClient) {
+	trackerHTTPMu.Lock()
+	defer trackerHTTPMu.Unlock()
+	trackerHTTP = c
+}
+
+// Returns the tracker client, creating the default one on first use.
+func trackerClient() *TrackerClient {
+	trackerHTTPMu.Lock()
+	defer trackerHTTPMu.Unlock()
+
+	if trackerHTTP == nil {
+		trackerHTTP, _ = NewTrackerClient(TrackerClientConfig{})
+	}
+	return trackerHTTP
+}
+
+// Apply the rewrite rules of the tracker's host to its announce URL.
+func (c *TrackerClient) rewrite(announce string) string {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return announce
+	}
+
+	for _, r := range c.cfg.Rewrites {
+		if r.Host == "" || strings.EqualFold(r.Host, u.Hostname()) {
+			announce = strings.ReplaceAll(announce, r.Old, r.New)
+		}
+	}
+	return announce
+}
+
+// GET a tracker URL over the given address family ("4", "6" or either),
+// returning the status code and the decompressed body.
+func (c *TrackerClient) get(rawURL, family string) (int, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	host := req.URL.Hostname()
+
+	req.Header.Set("User-Agent", c.cfg.UserAgent)
+	req.Header.Set("Accept-Encoding", "gzip")
+	for name, values := range c.cfg.Headers[host] {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	for _, cookie := range c.cfg.Cookies[host] {
+		req.AddCookie(cookie)
+	}
+
+	client, ok := c.clients[family]
+	if !ok {
+		client = c.clients[""]
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid gzip response: %v", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, maxTrackerResponse+1))
+	if err != nil {
+		return 0, nil, errors.New("failed to read tracker response: " + err.Error())
+	}
+	if len(data) > maxTrackerResponse {
+		return 0, nil, fmt.Errorf("tracker response larger than %d bytes", maxTrackerResponse)
+	}
+	return resp.StatusCode, data, nil
+}
+
+// Whether requests go through a proxy, which picks the address family itself.
+func (c *TrackerClient) proxied() bool {
+	return c.cfg.Proxy != ""
+}
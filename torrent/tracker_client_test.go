@@ -0,0 +1,151 @@
+package torrent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTrackerClientRequest(t *testing.T) {
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte("d8:intervali1800ee"))
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	c, err := NewTrackerClient(TrackerClientConfig{
+		Headers:  map[string]http.Header{u.Hostname(): {"X-Api-Key": {"secret"}}},
+		Cookies:  map[string][]*http.Cookie{u.Hostname(): {{Name: "uid", Value: "42"}}},
+		Rewrites: []RewriteRule{{Host: u.Hostname(), Old: "{passkey}", New: "abc123"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, data, err := c.get(c.rewrite(srv.URL+"/{passkey}/announce"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || string(data) != "d8:intervali1800ee" {
+		t.Errorf("get = %d %q", status, data)
+	}
+
+	if got.URL.Path != "/abc123/announce" {
+		t.Errorf("path = %s, want the passkey rewritten in", got.URL.Path)
+	}
+	if ua := got.Header.Get("User-Agent"); ua != DefaultUserAgent {
+		t.Errorf("user agent = %q, want %q", ua, DefaultUserAgent)
+	}
+	if key := got.Header.Get("X-Api-Key"); key != "secret" {
+		t.Errorf("X-Api-Key = %q, want secret", key)
+	}
+	if cookie, err := got.Cookie("uid"); err != nil || cookie.Value != "42" {
+		t.Errorf("uid cookie = %v, %v", cookie, err)
+	}
+}
+
+func TestTrackerClientRewriteOtherHost(t *testing.T) {
+	c, err := NewTrackerClient(TrackerClientConfig{
+		Rewrites: []RewriteRule{{Host: "tracker.example.org", Old: "{passkey}", New: "abc123"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	announce := "http://other.example.org/{passkey}/announce"
+	if got := c.rewrite(announce); got != announce {
+		t.Errorf("rewrite = %s, want it unchanged", got)
+	}
+}
+
+func TestTrackerClientGzip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Accept-Encoding = %q, want gzip", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("d8:intervali900ee"))
+		gz.Close()
+	}))
+	defer srv.Close()
+
+	c, err := NewTrackerClient(TrackerClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, data, err := c.get(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "d8:intervali900ee" {
+		t.Errorf("body = %q, want it decompressed", data)
+	}
+}
+
+func TestTrackerClientResponseLimit(t *testing.T) {
+	// A small compressed body that inflates past the limit
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(strings.Repeat("x", maxTrackerResponse+1)))
+	gz.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"plain", "", []byte(strings.Repeat("x", maxTrackerResponse+1))},
+		{"gzip", "gzip", buf.Bytes()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.Write(tt.body)
+			}))
+			defer srv.Close()
+
+			c, err := NewTrackerClient(TrackerClientConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := c.get(srv.URL, ""); err == nil {
+				t.Error("oversized response was accepted")
+			}
+		})
+	}
+}
+
+func TestTrackerClientErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("d14:failure reason12:unregisterede"))
+	}))
+	defer srv.Close()
+
+	c, err := NewTrackerClient(TrackerClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTrackerClient(c)
+	defer SetTrackerClient(nil)
+
+	tor := &Torrent{PeerId: PeerID, Port: Port, Length: 1}
+	_, err = tor.getTrackerResponse(srv.URL, hash{1}, eventStarted, "")
+
+	te, ok := err.(*TrackerError)
+	if !ok || te.StatusCode != http.StatusForbidden || te.Reason != "unregistered" {
+		t.Errorf("getTrackerResponse = %v, want a 403 with the tracker's reason", err)
+	}
+}
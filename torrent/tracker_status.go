@@ -0,0 +1,153 @@
+package torrent
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	trackerBackoffBase = 30 * time.Second // Delay after the first failed announce
+	trackerBackoffMax  = time.Hour        // Upper bound of the exponential backoff
+)
+
+// TrackerStatus is the state of a single tracker of the torrent.
+type TrackerStatus struct {
+	URL          string
+	Tier         int       // Index of the tracker's tier in the announce list
+	Working      bool      // The last announce succeeded
+	Updating     bool      // An announce is in progress
+	Error        string    // Error of the last failed announce
+	Warning      string    // `warning message` of the last response
+	Fails        int       // Number of announces failed in a row
+	Disabled     bool      // The tracker asked never to be retried (BEP 31)
+	TrackerID    string    // `tracker id` to send back on announces
+	LastAnnounce time.Time // Time of the last successful announce
+	NextAnnounce time.Time // Earliest time of the next announce
+}
+
+// Trackers returns the status of every tracker, in tier order.
+func (t *Torrent) Trackers() []TrackerStatus {
+	t.trackerMu.Lock()
+	defer t.trackerMu.Unlock()
+
+	statuses := []TrackerStatus{}
+	for i, tier := range t.AnnounceList {
+		for _, announce := range tier {
+			st := TrackerStatus{URL: announce}
+			if s, ok := t.trackers[announce]; ok {
+				st = *s
+			}
+			st.Tier = i
+			statuses = append(statuses, st)
+		}
+	}
+	return statuses
+}
+
+func (t *Torrent) trackerStatus(announce string) *TrackerStatus {
+	if t.trackers == nil {
+		t.trackers = map[string]*TrackerStatus{}
+	}
+
+	s, ok := t.trackers[announce]
+	if !ok {
+		s = &TrackerStatus{URL: announce}
+		t.trackers[announce] = s
+	}
+	return s
+}
+
+// The `tracker id` a tracker asked us to send back, if any.
+func (t *Torrent) trackerID(announce string) string {
+	t.trackerMu.Lock()
+	defer t.trackerMu.Unlock()
+	return t.trackerStatus(announce).TrackerID
+}
+
+// Check whether a tracker may be announced to now and mark it as updating.
+// Failing trackers are skipped until their backoff expires, except to tell
+// them we are leaving.
+func (t *Torrent) beginAnnounce(announce, event string) error {
+	t.trackerMu.Lock()
+	defer t.trackerMu.Unlock()
+
+	s := t.trackerStatus(announce)
+	if s.Disabled {
+		return errors.New("tracker asked never to be retried")
+	}
+	if s.Fails > 0 && event != eventStopped && time.Now().Before(s.NextAnnounce) {
+		return errors.New("backing off until " + s.NextAnnounce.Format(time.TimeOnly))
+	}
+
+	s.Updating = true
+	return nil
+}
+
+// Record the outcome of an announce started with beginAnnounce.
+func (t *Torrent) endAnnounce(announce string, tr *TrackerResponse, err error) {
+	t.trackerMu.Lock()
+	defer t.trackerMu.Unlock()
+
+	s := t.trackerStatus(announce)
+	s.Updating = false
+
+	if err == nil {
+		s.Working = true
+		s.Error = ""
+		s.Warning = tr.WarningMessage
+		if tr.TrackerID != "" {
+			s.TrackerID = tr.TrackerID
+		}
+		s.Fails = 0
+		s.LastAnnounce = time.Now()
+
+		interval := defaultAnnounceInterval
+		if tr.Interval > 0 {
+			interval = time.Duration(tr.Interval) * time.Second
+		}
+		s.NextAnnounce = s.LastAnnounce.Add(interval)
+		return
+	}
+
+	s.Working = false
+	s.Error = err.Error()
+	s.Fails++
+	s.NextAnnounce = time.Now().Add(trackerBackoff(s.Fails))
+
+	// The tracker knows best when it wants to hear from us again
+	var te *TrackerError
+	if errors.As(err, &te) {
+		switch {
+		case te.Never:
+			s.Disabled = true
+		case te.RetryIn > 0:
+			s.NextAnnounce = time.Now().Add(time.Duration(te.RetryIn) * time.Minute)
+		}
+	}
+}
+
+// Exponential backoff after the given number of failed announces.
+func trackerBackoff(fails int) time.Duration {
+	d := trackerBackoffBase
+	for i := 1; i < fails && d < trackerBackoffMax; i++ {
+		d *= 2
+	}
+	return min(d, trackerBackoffMax)
+}
+
+// Earliest time a failing tracker may be retried, zero if none is waiting.
+func (t *Torrent) nextTrackerRetry() time.Time {
+	t.trackerMu.Lock()
+	defer t.trackerMu.Unlock()
+
+	var next time.Time
+	for _, s := range t.trackers {
+		if s.Disabled || s.Fails == 0 {
+			continue
+		}
+		if next.IsZero() || s.NextAnnounce.Before(next) {
+			next = s.NextAnnounce
+		}
+	}
+	return next
+}
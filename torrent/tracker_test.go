@@ -0,0 +1,176 @@
+package torrent
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/AcidOP/torrly/tracker"
+)
+
+// A torrent of a single piece announcing to `announce` as peer `id` on `port`.
+func trackerTestTorrent(announce, id string, port int, seeding bool) *Torrent {
+	t := &Torrent{
+		AnnounceList: [][]string{{announce}},
+		InfoHash:     hash{1, 2, 3},
+		HasV1:        true,
+		PeerId:       id,
+		Port:         port,
+		Length:       1000,
+		PieceLength:  1000,
+	}
+	if seeding {
+		t.PieceVerified(0)
+	}
+	return t
+}
+
+func TestTrackerServerSwarm(t *testing.T) {
+	srv := httptest.NewServer(tracker.NewServer())
+	defer srv.Close()
+	announce := srv.URL + "/announce"
+
+	seeder := trackerTestTorrent(announce, "-TRLY01-seeder000001", 7001, true)
+	leecher := trackerTestTorrent(announce, "-TRLY01-leecher00001", 7002, false)
+
+	if _, err := seeder.announce(announce, seeder.InfoHash, eventStarted); err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := leecher.announce(announce, leecher.InfoHash, eventStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Interval != int(tracker.DefaultInterval.Seconds()) {
+		t.Errorf("interval = %d, want %v", tr.Interval, tracker.DefaultInterval)
+	}
+	if tr.Completed != 1 || tr.Incomplete != 1 {
+		t.Errorf("swarm has %d seeders and %d leechers, want 1 and 1", tr.Completed, tr.Incomplete)
+	}
+	if len(tr.Peers) != 1 || tr.Peers[0].IP != "127.0.0.1" || tr.Peers[0].Port != 7001 {
+		t.Errorf("leecher got peers %+v, want the seeder at 127.0.0.1:7001", tr.Peers)
+	}
+
+	res, err := leecher.Scrape()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Complete != 1 || res.Incomplete != 1 {
+		t.Errorf("scrape = %+v, want 1 seeder and 1 leecher", res)
+	}
+
+	// The leecher finishes and leaves
+	leecher.PieceVerified(0)
+	if _, err := leecher.announce(announce, leecher.InfoHash, eventCompleted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leecher.announce(announce, leecher.InfoHash, eventStopped); err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err = seeder.announce(announce, seeder.InfoHash, eventNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Completed != 1 || tr.Incomplete != 0 || len(tr.Peers) != 0 {
+		t.Errorf("after the leecher left: %d seeders, %d leechers, peers %+v", tr.Completed, tr.Incomplete, tr.Peers)
+	}
+
+	res, err = seeder.Scrape()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Downloaded != 1 {
+		t.Errorf("scrape downloaded = %d, want 1", res.Downloaded)
+	}
+}
+
+func TestTrackerServerAllowlist(t *testing.T) {
+	s := tracker.NewServer()
+	s.Allow(hash{9})
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	announce := srv.URL + "/announce"
+
+	tor := trackerTestTorrent(announce, "-TRLY01-leecher00001", 7002, false)
+	_, err := tor.announce(announce, tor.InfoHash, eventStarted)
+
+	var te *TrackerError
+	if !errors.As(err, &te) || te.Reason == "" {
+		t.Errorf("announce of an unregistered torrent = %v, want a failure reason", err)
+	}
+}
+
+func TestBuildTrackerURL(t *testing.T) {
+	tor := &Torrent{PeerId: PeerID, Port: Port, Length: 100, NumWant: 30, AnnounceIP: "203.0.113.7"}
+	ih := hash{1}
+
+	tests := []struct {
+		noCompact bool
+		compact   string
+	}{
+		{false, "1"},
+		{true, "0"},
+	}
+
+	for _, tt := range tests {
+		tor.NoCompact = tt.noCompact
+
+		raw, err := tor.buildTrackerURL("http://t.example/announce?passkey=abc", ih, eventStarted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := u.Query()
+		want := map[string]string{
+			"passkey":    "abc",
+			"info_hash":  string(ih[:]),
+			"peer_id":    PeerID,
+			"port":       strconv.Itoa(Port),
+			"left":       "100",
+			"event":      eventStarted,
+			"numwant":    "30",
+			"ip":         "203.0.113.7",
+			"compact":    tt.compact,
+			"no_peer_id": "1",
+		}
+		for key, value := range want {
+			if got := q.Get(key); got != value {
+				t.Errorf("no compact = %v: %s = %q, want %q", tt.noCompact, key, got, value)
+			}
+		}
+		if q.Get("key") == "" {
+			t.Error("announce has no key")
+		}
+	}
+}
+
+func TestTrackerServerDictPeers(t *testing.T) {
+	srv := httptest.NewServer(tracker.NewServer())
+	defer srv.Close()
+	announce := srv.URL + "/announce"
+
+	seeder := trackerTestTorrent(announce, "-TRLY01-seeder000001", 7001, true)
+	if _, err := seeder.announce(announce, seeder.InfoHash, eventStarted); err != nil {
+		t.Fatal(err)
+	}
+
+	leecher := trackerTestTorrent(announce, "-TRLY01-leecher00001", 7002, false)
+	leecher.NoCompact = true
+
+	tr, err := leecher.announce(announce, leecher.InfoHash, eventStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A list of dictionaries, without the peer IDs we asked to leave out
+	if len(tr.Peers) != 1 || tr.Peers[0].IP != "127.0.0.1" || tr.Peers[0].Port != 7001 || tr.Peers[0].PeerId != "" {
+		t.Errorf("peers = %+v, want the seeder at 127.0.0.1:7001 without its peer ID", tr.Peers)
+	}
+}
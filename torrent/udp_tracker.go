@@ -0,0 +1,352 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol.
+// https://www.bittorrent.org/beps/bep_0015.html
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// Connection IDs are valid for one minute after they were received
+	udpConnectionIDTTL = time.Minute
+
+	// Retransmit after 15 * 2^n seconds, for n up to 8
+	udpDefaultTimeout    = 15 * time.Second
+	udpDefaultMaxRetries = 8
+
+	// The full retry schedule takes over two hours. Torrents share the
+	// trackers and wait for each other, so their requests give up sooner.
+	udpRequestDeadline = time.Minute
+	udpStoppedDeadline = 10 * time.Second // Nobody waits for the answer to `stopped`
+
+	// At most 74 info hashes fit into a single scrape request
+	udpMaxScrapeHashes = 74
+
+	udpMaxPacketSize = 2048
+)
+
+// Announce events, as numbered by the UDP tracker protocol.
+const (
+	udpEventNone      = 0
+	udpEventCompleted = 1
+	udpEventStarted   = 2
+	udpEventStopped   = 3
+)
+
+// UDPTracker is a client for a single UDP tracker.
+// It caches the connection ID and can be shared between torrents.
+type UDPTracker struct {
+	Addr       string        // host:port of the tracker
+	Network    string        // "udp", or "udp4"/"udp6" to use a single address family
+	Timeout    time.Duration // Base retransmission timeout, doubled on every retry
+	MaxRetries int           // Number of retransmissions before giving up
+	Deadline   time.Duration // Limit on a whole request including retries, 0 for none
+
+	mu          sync.Mutex // Serializes requests and guards the connection ID
+	connID      uint64
+	connExpires time.Time
+	ipv6        bool // Whether the last request went over IPv6
+}
+
+// UDPAnnounce holds the fields of an announce request.
+type UDPAnnounce struct {
+	InfoHash   hash
+	PeerID     [20]byte
+	Downloaded int64
+	Left       int64
+	Uploaded   int64
+	Event      uint32
+	IP         uint32 // IPv4 address to announce, 0 means the sender's
+	Key        uint32
+	NumWant    int32 // -1 lets the tracker decide
+	Port       uint16
+}
+
+// ScrapeResult holds the swarm statistics of one torrent.
+type ScrapeResult struct {
+	Complete   int `bencode:"complete"`   // Seeders
+	Downloaded int `bencode:"downloaded"` // Number of completed downloads
+	Incomplete int `bencode:"incomplete"` // Leechers
+}
+
+// A tracker that answered with an error action packet.
+type UDPTrackerError struct {
+	Addr    string
+	Message string
+}
+
+func (e *UDPTrackerError) Error() string {
+	return fmt.Sprintf("udp tracker %s: %s", e.Addr, e.Message)
+}
+
+// Map an announce event to its UDP tracker protocol number.
+func udpEvent(event string) uint32 {
+	switch event {
+	case eventCompleted:
+		return udpEventCompleted
+	case eventStarted:
+		return udpEventStarted
+	case eventStopped:
+		return udpEventStopped
+	default:
+		return udpEventNone
+	}
+}
+
+var (
+	udpTrackersMu sync.Mutex
+	udpTrackers   = map[string]*UDPTracker{}
+)
+
+// Returns the shared client for the UDP tracker at `addr` over `network`,
+// so connection IDs are reused across announces and torrents.
+func udpTrackerFor(network, addr string) *UDPTracker {
+	udpTrackersMu.Lock()
+	defer udpTrackersMu.Unlock()
+
+	key := network + "/" + addr
+	if tr, ok := udpTrackers[key]; ok {
+		return tr
+	}
+
+	tr := NewUDPTracker(addr)
+	tr.Network = network
+	tr.Deadline = udpRequestDeadline
+	udpTrackers[key] = tr
+	return tr
+}
+
+func NewUDPTracker(addr string) *UDPTracker {
+	return &UDPTracker{
+		Addr:       addr,
+		Network:    "udp",
+		Timeout:    udpDefaultTimeout,
+		MaxRetries: udpDefaultMaxRetries,
+	}
+}
+
+// Announce sends an announce request and returns the tracker's response.
+func (tr *UDPTracker) Announce(req UDPAnnounce) (*TrackerResponse, error) {
+	return tr.announce(req, tr.Deadline)
+}
+
+// Announce, giving up after `limit` (0 for no limit).
+func (tr *UDPTracker) announce(req UDPAnnounce, limit time.Duration) (*TrackerResponse, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	res, err := tr.roundTrip(deadlineAfter(limit), udpActionAnnounce, func(buf *bytes.Buffer) {
+		buf.Write(req.InfoHash[:])
+		buf.Write(req.PeerID[:])
+		binary.Write(buf, binary.BigEndian, req.Downloaded)
+		binary.Write(buf, binary.BigEndian, req.Left)
+		binary.Write(buf, binary.BigEndian, req.Uploaded)
+		binary.Write(buf, binary.BigEndian, req.Event)
+		binary.Write(buf, binary.BigEndian, req.IP)
+		binary.Write(buf, binary.BigEndian, req.Key)
+		binary.Write(buf, binary.BigEndian, req.NumWant)
+		binary.Write(buf, binary.BigEndian, req.Port)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// interval(4) leechers(4) seeders(4) followed by compact peers
+	if len(res) < 12 {
+		return nil, fmt.Errorf("udp tracker %s: announce response too short: %d bytes", tr.Addr, len(res))
+	}
+
+	resp := &TrackerResponse{
+		Interval:   int(binary.BigEndian.Uint32(res[0:4])),
+		Incomplete: int(binary.BigEndian.Uint32(res[4:8])),
+		Completed:  int(binary.BigEndian.Uint32(res[8:12])),
+	}
+
+	// Peers are of the same address family as the tracker's address
+	if tr.ipv6 {
+		err = (*peerList)(&resp.Peers6).parseCompact(res[12:], compactPeer6Len)
+	} else {
+		err = resp.Peers.parseCompact(res[12:], compactPeerLen)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Scrape returns the swarm statistics of each info hash, in the same order.
+// Requests with more hashes than fit in one packet are split up.
+func (tr *UDPTracker) Scrape(infoHashes []hash) ([]ScrapeResult, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	deadline := deadlineAfter(tr.Deadline)
+
+	for start := 0; start < len(infoHashes); start += udpMaxScrapeHashes {
+		batch := infoHashes[start:min(start+udpMaxScrapeHashes, len(infoHashes))]
+
+		res, err := tr.roundTrip(deadline, udpActionScrape, func(buf *bytes.Buffer) {
+			for _, h := range batch {
+				buf.Write(h[:])
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// seeders(4) completed(4) leechers(4) per info hash
+		if len(res) < 12*len(batch) {
+			return nil, fmt.Errorf("udp tracker %s: scrape response too short: %d bytes", tr.Addr, len(res))
+		}
+
+		for i := range batch {
+			r := res[i*12:]
+			results = append(results, ScrapeResult{
+				Complete:   int(binary.BigEndian.Uint32(r[0:4])),
+				Downloaded: int(binary.BigEndian.Uint32(r[4:8])),
+				Incomplete: int(binary.BigEndian.Uint32(r[8:12])),
+			})
+		}
+	}
+	return results, nil
+}
+
+// The time a request limited to `limit` must be done by, zero for no limit.
+func deadlineAfter(limit time.Duration) time.Time {
+	if limit <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(limit)
+}
+
+// Send a request with the given action and return the response payload
+// that follows the action and transaction ID. Connects first if the
+// cached connection ID is missing or expired. Retransmissions stop at
+// `deadline` unless it is zero. Callers MUST hold tr.mu.
+func (tr *UDPTracker) roundTrip(deadline time.Time, action uint32, body func(*bytes.Buffer)) ([]byte, error) {
+	conn, err := net.Dial(tr.Network, tr.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	tr.ipv6 = conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil
+
+	for attempt := 0; attempt <= tr.MaxRetries; attempt++ {
+		timeout := tr.Timeout * time.Duration(1<<attempt)
+
+		// Wait no longer than the deadline allows for each packet
+		remaining := func() time.Duration {
+			if deadline.IsZero() {
+				return timeout
+			}
+			return min(timeout, time.Until(deadline))
+		}
+		if remaining() <= 0 {
+			break
+		}
+
+		if time.Now().After(tr.connExpires) {
+			res, err := tr.transact(conn, udpProtocolID, udpActionConnect, nil, remaining())
+			if isTimeout(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			if len(res) < 8 {
+				return nil, fmt.Errorf("udp tracker %s: connect response too short", tr.Addr)
+			}
+			tr.connID = binary.BigEndian.Uint64(res[0:8])
+			tr.connExpires = time.Now().Add(udpConnectionIDTTL)
+		}
+
+		if remaining() <= 0 {
+			break
+		}
+		res, err := tr.transact(conn, tr.connID, action, body, remaining())
+		if isTimeout(err) {
+			continue
+		}
+		return res, err
+	}
+
+	// The connection ID may be stale if the tracker stopped answering
+	tr.connExpires = time.Time{}
+	return nil, fmt.Errorf("udp tracker %s: no response", tr.Addr)
+}
+
+// Send one packet and wait for the response with a matching transaction ID.
+// Packets with other transaction IDs are ignored.
+func (tr *UDPTracker) transact(conn net.Conn, connID uint64, action uint32,
+	body func(*bytes.Buffer), timeout time.Duration) ([]byte, error) {
+	txID, err := randomUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.Buffer{}
+	binary.Write(&buf, binary.BigEndian, connID)
+	binary.Write(&buf, binary.BigEndian, action)
+	binary.Write(&buf, binary.BigEndian, txID)
+	if body != nil {
+		body(&buf)
+	}
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	packet := make([]byte, udpMaxPacketSize)
+	for {
+		n, err := conn.Read(packet)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 8 || binary.BigEndian.Uint32(packet[4:8]) != txID {
+			continue
+		}
+
+		switch got := binary.BigEndian.Uint32(packet[0:4]); got {
+		case action:
+			return append([]byte(nil), packet[8:n]...), nil
+		case udpActionError:
+			return nil, &UDPTrackerError{Addr: tr.Addr, Message: string(packet[8:n])}
+		default:
+			return nil, fmt.Errorf("udp tracker %s: unexpected action %d, expected %d", tr.Addr, got, action)
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func randomUint32() (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
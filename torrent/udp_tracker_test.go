@@ -0,0 +1,141 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// udpStandIn is a UDP tracker that answers connect and announce requests
+// with a fixed peer, or drops every packet when `silent` is set.
+type udpStandIn struct {
+	conn     *net.UDPConn
+	silent   atomic.Bool
+	failWith string // Answer announces with this error message instead
+	connects atomic.Int32
+	events   chan uint32
+}
+
+func newUDPStandIn(t *testing.T, failWith string) *udpStandIn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &udpStandIn{conn: conn, failWith: failWith, events: make(chan uint32, 16)}
+	go s.serve()
+	return s
+}
+
+func (s *udpStandIn) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *udpStandIn) serve() {
+	const connID = 0x1122334455667788
+	buf := make([]byte, udpMaxPacketSize)
+
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 || s.silent.Load() {
+			continue
+		}
+
+		action := binary.BigEndian.Uint32(buf[8:12])
+		txID := binary.BigEndian.Uint32(buf[12:16])
+		res := binary.BigEndian.AppendUint32(nil, action)
+		res = binary.BigEndian.AppendUint32(res, txID)
+
+		switch {
+		case action == udpActionConnect && binary.BigEndian.Uint64(buf[0:8]) == udpProtocolID:
+			s.connects.Add(1)
+			res = binary.BigEndian.AppendUint64(res, connID)
+		case action == udpActionAnnounce && binary.BigEndian.Uint64(buf[0:8]) == connID && n >= 98:
+			s.events <- binary.BigEndian.Uint32(buf[80:84])
+			if s.failWith != "" {
+				binary.BigEndian.PutUint32(res[0:4], udpActionError)
+				res = append(res, s.failWith...)
+				break
+			}
+			res = binary.BigEndian.AppendUint32(res, 1800) // interval
+			res = binary.BigEndian.AppendUint32(res, 1)    // leechers
+			res = binary.BigEndian.AppendUint32(res, 2)    // seeders
+			res = append(res, 10, 0, 0, 1, 0x1a, 0xe1)     // 10.0.0.1:6881
+		default:
+			continue
+		}
+		s.conn.WriteToUDP(res, from)
+	}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	s := newUDPStandIn(t, "")
+	tr := NewUDPTracker(s.addr())
+
+	for i := 0; i < 2; i++ {
+		res, err := tr.Announce(UDPAnnounce{Event: udpEventStarted, NumWant: -1, Port: 6881})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Interval != 1800 || res.Incomplete != 1 || res.Completed != 2 {
+			t.Errorf("response = %+v, want interval 1800, 1 leecher and 2 seeders", res)
+		}
+		if len(res.Peers) != 1 || res.Peers[0].IP != "10.0.0.1" || res.Peers[0].Port != 6881 {
+			t.Errorf("peers = %+v, want [10.0.0.1:6881]", res.Peers)
+		}
+		if event := <-s.events; event != udpEventStarted {
+			t.Errorf("event = %d, want %d", event, udpEventStarted)
+		}
+	}
+
+	// The connection ID is reused while it is valid
+	if n := s.connects.Load(); n != 1 {
+		t.Errorf("connected %d times, want 1", n)
+	}
+}
+
+func TestUDPAnnounceError(t *testing.T) {
+	s := newUDPStandIn(t, "unregistered torrent")
+
+	_, err := NewUDPTracker(s.addr()).Announce(UDPAnnounce{})
+
+	var ue *UDPTrackerError
+	if !errors.As(err, &ue) || ue.Message != "unregistered torrent" {
+		t.Errorf("Announce = %v, want the tracker's error message", err)
+	}
+}
+
+func TestUDPAnnounceDeadline(t *testing.T) {
+	s := newUDPStandIn(t, "")
+	s.silent.Store(true)
+
+	tr := NewUDPTracker(s.addr())
+	tr.Timeout = 50 * time.Millisecond
+	tr.Deadline = 300 * time.Millisecond
+
+	start := time.Now()
+	if _, err := tr.Announce(UDPAnnounce{}); err == nil {
+		t.Fatal("Announce to a silent tracker succeeded")
+	}
+
+	// Without the deadline the retries would take 50ms * (2^9 - 1)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Announce gave up after %v, want about %v", elapsed, tr.Deadline)
+	}
+
+	// The tracker answers again: the next request goes through
+	s.silent.Store(false)
+	if _, err := tr.Announce(UDPAnnounce{}); err != nil {
+		t.Errorf("Announce after the tracker came back = %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// BitTorrent v2 metainfo support.
+// https://www.bittorrent.org/beps/bep_0052.html
+
+type hashV2 = [32]byte
+
+const (
+	metaVersion2   = 2
+	minPieceLength = 16 * 1024 // v2 piece length MUST be a power of two >= 16 KiB
+)
+
+// Truncated v2 info hash, used in the handshake and tracker announces
+// when joining the v2 swarm.
+func (t *Torrent) InfoHashV2Short() hash {
+	var h hash
+	copy(h[:], t.InfoHashV2[:])
+	return h
+}
+
+// Info hashes identifying the swarms this torrent can join.
+// Hybrid torrents are part of both the v1 and the v2 swarm.
+func (t *Torrent) swarmHashes() []hash {
+	hashes := []hash{}
+	if t.HasV1 {
+		hashes = append(hashes, t.InfoHash)
+	}
+	if t.HasV2 {
+		hashes = append(hashes, t.InfoHashV2Short())
+	}
+	return hashes
+}
+
+// Size of the space the pieces cover: the end of the last file. Files of
+// v2-only torrents start on piece boundaries, so it can exceed Length.
+func (t *Torrent) dataLength() int {
+	end := 0
+	for _, f := range t.Files {
+		if f.Length > 0 {
+			end = max(end, f.Offset+f.Length)
+		}
+	}
+	return end
+}
+
+// Number of pieces of the torrent, counting those of every file for
+// v2-only torrents, which have no v1 piece hashes.
+func (t *Torrent) numPieces() int {
+	if len(t.PieceHashes) > 0 || t.PieceLength <= 0 {
+		return len(t.PieceHashes)
+	}
+	return (t.dataLength() + t.PieceLength - 1) / t.PieceLength
+}
+
+// Check that the piece length is valid for a v2 torrent.
+func validateV2PieceLength(pieceLength int) error {
+	if pieceLength < minPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return fmt.Errorf("invalid v2 piece length %d: must be a power of two >= %d",
+			pieceLength, minPieceLength)
+	}
+	return nil
+}
+
+// Parse the `file tree` of a v2 info dictionary into a file table.
+// Files are ordered by path, as the keys of a bencoded dictionary are,
+// and each one starts on a piece boundary (BEP 52).
+func parseFileTree(rawInfo []byte, pieceLength int) ([]File, error) {
+	info := struct {
+		FileTree map[string]interface{} `bencode:"file tree"`
+	}{}
+
+	if err := unmarshalLenient(rawInfo, &info); err != nil {
+		return nil, errors.New("failed to decode file tree: " + err.Error())
+	}
+
+	if len(info.FileTree) == 0 {
+		return nil, errors.New("v2 info dictionary has no file tree")
+	}
+
+	files := []File{}
+	if err := walkFileTree(info.FileTree, nil, &files); err != nil {
+		return nil, err
+	}
+
+	offset := 0
+	for i := range files {
+		offset = (offset + pieceLength - 1) / pieceLength * pieceLength
+		files[i].Offset = offset
+		offset += files[i].Length
+	}
+	return files, nil
+}
+
+// Recursively collect the files of a `file tree` node.
+// A file is a node whose only key is the empty string.
+func walkFileTree(node map[string]interface{}, path []string, files *[]File) error {
+	names := make([]string, 0, len(node))
+	for name := range node {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !validPathComponent(name) {
+			return fmt.Errorf("invalid path component in file tree: %q", name)
+		}
+
+		child, ok := node[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("file tree entry %q is not a dictionary", name)
+		}
+
+		childPath := append(append([]string{}, path...), name)
+
+		entry, isFile := child[""].(map[string]interface{})
+		if !isFile {
+			if err := walkFileTree(child, childPath, files); err != nil {
+				return err
+			}
+			continue
+		}
+
+		length, ok := entry["length"].(int64)
+		if !ok || length < 0 {
+			return fmt.Errorf("file %q has an invalid length", filepath.Join(childPath...))
+		}
+
+		f := File{Path: filepath.Join(childPath...), Length: int(length)}
+		f.Attr, _ = entry["attr"].(string)
+
+		symlinkPath := []string{}
+		if components, ok := entry["symlink path"].([]interface{}); ok {
+			for _, c := range components {
+				s, _ := c.(string)
+				symlinkPath = append(symlinkPath, s)
+			}
+		}
+		if err := f.setSymlinkPath(symlinkPath); err != nil {
+			return err
+		}
+
+		// Empty files have no pieces root
+		if root, ok := entry["pieces root"].(string); ok {
+			if len(root) != len(f.PiecesRoot) {
+				return fmt.Errorf("file %q has an invalid pieces root", f.Path)
+			}
+			copy(f.PiecesRoot[:], root)
+		} else if length > 0 {
+			return fmt.Errorf("file %q has no pieces root", f.Path)
+		}
+
+		*files = append(*files, f)
+	}
+	return nil
+}
+
+// Attach the v2 pieces roots to the files of a hybrid torrent's v1 file table.
+// Both file lists MUST describe the same files (padding files excluded).
+func attachPiecesRoots(files []File, v2Files []File) error {
+	roots := make(map[string]File, len(v2Files))
+	for _, f := range v2Files {
+		roots[f.Path] = f
+	}
+
+	matched := 0
+	for i := range files {
+		v2, ok := roots[files[i].Path]
+		if !ok {
+			continue
+		}
+
+		if v2.Length != files[i].Length {
+			return fmt.Errorf("hybrid torrent file %q has different v1 and v2 lengths", files[i].Path)
+		}
+		files[i].PiecesRoot = v2.PiecesRoot
+		matched++
+	}
+
+	if matched != len(v2Files) {
+		return fmt.Errorf("hybrid torrent file lists differ: %d of %d v2 files found in v1 list",
+			matched, len(v2Files))
+	}
+	return nil
+}
+
+// Validate and store the `piece layers` of a v2 torrent.
+// Each layer is the concatenated SHA-256 hashes of a file's pieces,
+// keyed by the file's pieces root. Files no longer than one piece have none.
+func (t *Torrent) setPieceLayers(layers map[string]string) error {
+	t.PieceLayers = make(map[hashV2][]hashV2, len(layers))
+
+	for _, f := range t.Files {
+		if f.Length <= t.PieceLength {
+			continue
+		}
+
+		layer, ok := layers[string(f.PiecesRoot[:])]
+		if !ok {
+			return fmt.Errorf("missing piece layer for file %q", f.Path)
+		}
+
+		numPieces := (f.Length + t.PieceLength - 1) / t.PieceLength
+		if len(layer) != numPieces*len(hashV2{}) {
+			return fmt.Errorf("piece layer of file %q has %d bytes, expected %d",
+				f.Path, len(layer), numPieces*len(hashV2{}))
+		}
+
+		hashes := make([]hashV2, numPieces)
+		for i := range hashes {
+			copy(hashes[i][:], layer[i*len(hashV2{}):])
+		}
+		t.PieceLayers[f.PiecesRoot] = hashes
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestV2FilesStartOnPieceBoundaries(t *testing.T) {
+	const pieceLength = 16384
+	root := func(b byte) string { return strings.Repeat(string(rune('a'+b)), 32) }
+
+	info := map[string]any{
+		"name":         "album",
+		"meta version": 2,
+		"piece length": pieceLength,
+		"file tree": map[string]any{
+			"a.flac": map[string]any{"": map[string]any{"length": 20000, "pieces root": root(0)}},
+			"b.flac": map[string]any{"": map[string]any{"length": 5000, "pieces root": root(1)}},
+			"sub": map[string]any{
+				"c.txt": map[string]any{"": map[string]any{"length": 100, "pieces root": root(2)}},
+			},
+		},
+	}
+	top := map[string]any{
+		"piece layers": map[string]any{root(0): strings.Repeat("x", 64)},
+	}
+	path, _ := writeTestTorrent(t, top, info)
+
+	tor, err := NewTorrentFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tor.HasV1 || !tor.HasV2 {
+		t.Fatalf("v1 = %v, v2 = %v, want a v2-only torrent", tor.HasV1, tor.HasV2)
+	}
+
+	// a.flac takes two pieces, the others one each
+	offsets := []int{}
+	for _, f := range tor.Files {
+		offsets = append(offsets, f.Offset)
+	}
+	if want := []int{0, 2 * pieceLength, 3 * pieceLength}; !slices.Equal(offsets, want) {
+		t.Errorf("file offsets = %v, want %v", offsets, want)
+	}
+	if tor.Length != 25100 {
+		t.Errorf("length = %d, want the sum of the file sizes", tor.Length)
+	}
+
+	tor.SelectedFiles = []int{1}
+	if wanted := tor.wantedPieces(); !slices.Equal(wanted, []bool{false, false, true, false}) {
+		t.Errorf("wanted pieces = %v, want only piece 2", wanted)
+	}
+
+	// Piece 2 is b.flac alone
+	dir := t.TempDir()
+	storage, err := tor.NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{7}, 5000)
+	if err := storage.WritePiece(2, data); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "album", "b.flac"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("b.flac = %d bytes (%v), want the 5000 bytes of piece 2", len(got), err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "album", "a.flac")); err == nil {
+		t.Error("piece 2 was written to a.flac")
+	}
+}
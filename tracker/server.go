@@ -0,0 +1,382 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AcidOP/torrly/bencode"
+)
+
+type hash = [20]byte
+
+const (
+	DefaultInterval = 30 * time.Minute
+	defaultNumWant  = 50
+	maxNumWant      = 200
+
+	// Without an allowlist anyone can add swarms and peers, so both are
+	// capped. The least recently announced ones make room for new ones.
+	maxSwarms        = 10000
+	maxPeersPerSwarm = 5000
+
+	// Announces are a single small GET, so slow clients are cut off early
+	// instead of tying up a connection each
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+// Server is an HTTP BitTorrent tracker keeping its swarms in memory.
+// It answers announces on /announce and scrapes on /scrape.
+// https://www.bittorrent.org/beps/bep_0003.html#trackers
+type Server struct {
+	Interval    time.Duration // Interval clients are asked to re-announce at
+	MinInterval time.Duration // Minimum interval between announces, 0 to leave out
+	PeerTTL     time.Duration // Peers that haven't announced for this long are dropped
+	Allowed     map[hash]bool // Info hashes the tracker serves, nil serves any torrent
+
+	mu     sync.Mutex
+	swarms map[hash]*swarm
+}
+
+func NewServer() *Server {
+	return &Server{
+		Interval: DefaultInterval,
+		PeerTTL:  2 * DefaultInterval,
+		swarms:   map[hash]*swarm{},
+	}
+}
+
+// Allow adds an info hash to the allowlist. Once the allowlist is non-empty
+// the tracker refuses every torrent not on it.
+func (s *Server) Allow(infoHash hash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Allowed == nil {
+		s.Allowed = map[hash]bool{}
+	}
+	s.Allowed[infoHash] = true
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	done := make(chan struct{})
+	defer close(done)
+	go s.expireLoop(done)
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	return srv.ListenAndServe()
+}
+
+// Run an expiry pass every half PeerTTL until `done` is closed, so swarms
+// nobody announces to anymore don't stay in memory forever.
+func (s *Server) expireLoop(done <-chan struct{}) {
+	if s.PeerTTL <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.PeerTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.expire()
+		}
+	}
+}
+
+// Make room for another swarm by dropping the one announced to least
+// recently. Callers MUST hold s.mu.
+func (s *Server) evictSwarm() {
+	var (
+		oldest hash
+		seen   time.Time
+		found  bool
+	)
+	for ih, sw := range s.swarms {
+		if last := sw.lastSeen(); !found || last.Before(seen) {
+			oldest, seen, found = ih, last, true
+		}
+	}
+	delete(s.swarms, oldest)
+}
+
+// Drop the expired peers of every swarm, and the swarms left empty.
+func (s *Server) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ih, sw := range s.swarms {
+		sw.expire(s.PeerTTL)
+		if len(sw.peers) == 0 {
+			delete(s.swarms, ih)
+		}
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/announce":
+		s.announce(w, r)
+	case "/scrape":
+		s.scrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type announceResponse struct {
+	Interval    int                `bencode:"interval"`
+	MinInterval int                `bencode:"min interval,omitempty"`
+	Complete    int                `bencode:"complete"`
+	Incomplete  int                `bencode:"incomplete"`
+	Peers       bencode.RawMessage `bencode:"peers"`            // Compact string or list of dictionaries
+	Peers6      []byte             `bencode:"peers6,omitempty"` // Compact IPv6 peers (BEP 7)
+	ExternalIP  []byte             `bencode:"external ip"`      // The client's address as we see it (BEP 24)
+}
+
+type peerDict struct {
+	PeerID string `bencode:"peer id,omitempty"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+func (s *Server) announce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	infoHash, err := parseHash(q.Get("info_hash"))
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	p, err := parsePeer(q, r.RemoteAddr)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	numWant := defaultNumWant
+	if v := q.Get("numwant"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			numWant = min(n, maxNumWant)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Allowed != nil && !s.Allowed[infoHash] {
+		writeFailure(w, "torrent not registered with this tracker")
+		return
+	}
+
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		if len(s.swarms) >= maxSwarms {
+			s.evictSwarm()
+		}
+		sw = newSwarm()
+		s.swarms[infoHash] = sw
+	}
+	sw.expire(s.PeerTTL)
+
+	switch q.Get("event") {
+	case "stopped":
+		delete(sw.peers, p.key())
+		if len(sw.peers) == 0 {
+			delete(s.swarms, infoHash)
+		}
+		writeResponse(w, announceResponse{
+			Interval:   int(s.Interval.Seconds()),
+			Peers:      bencode.RawMessage("0:"),
+			ExternalIP: p.IP,
+		})
+		return
+	case "completed":
+		if prev, ok := sw.peers[p.key()]; !ok || prev.Left != 0 {
+			sw.downloaded++
+		}
+	}
+
+	if _, ok := sw.peers[p.key()]; !ok && len(sw.peers) >= maxPeersPerSwarm {
+		sw.evict()
+	}
+	sw.peers[p.key()] = p
+
+	resp := announceResponse{
+		Interval:    int(s.Interval.Seconds()),
+		MinInterval: int(s.MinInterval.Seconds()),
+		ExternalIP:  p.IP,
+	}
+	resp.Complete, resp.Incomplete = sw.counts()
+
+	picked := sw.pick(numWant, p)
+	if q.Get("compact") == "1" {
+		resp.Peers, resp.Peers6 = compactPeers(picked)
+	} else {
+		resp.Peers, err = dictPeers(picked, q.Get("no_peer_id") == "1")
+		if err != nil {
+			writeFailure(w, err.Error())
+			return
+		}
+	}
+	writeResponse(w, resp)
+}
+
+type scrapeResponse struct {
+	Files map[string]scrapeFile `bencode:"files"`
+}
+
+type scrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+// Answer a scrape for the requested info hashes, or for every torrent
+// the tracker knows if none are given.
+func (s *Server) scrape(w http.ResponseWriter, r *http.Request) {
+	hashes := []hash{}
+	for _, v := range r.URL.Query()["info_hash"] {
+		ih, err := parseHash(v)
+		if err != nil {
+			writeFailure(w, err.Error())
+			return
+		}
+		hashes = append(hashes, ih)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(hashes) == 0 {
+		for ih := range s.swarms {
+			hashes = append(hashes, ih)
+		}
+	}
+
+	resp := scrapeResponse{Files: map[string]scrapeFile{}}
+	for _, ih := range hashes {
+		sw, ok := s.swarms[ih]
+		if !ok || (s.Allowed != nil && !s.Allowed[ih]) {
+			continue
+		}
+		sw.expire(s.PeerTTL)
+		if len(sw.peers) == 0 {
+			delete(s.swarms, ih)
+			continue
+		}
+
+		f := scrapeFile{Downloaded: sw.downloaded}
+		f.Complete, f.Incomplete = sw.counts()
+		resp.Files[string(ih[:])] = f
+	}
+	writeResponse(w, resp)
+}
+
+func parseHash(v string) (hash, error) {
+	var ih hash
+	if len(v) != len(ih) {
+		return ih, fmt.Errorf("invalid info_hash: %d bytes", len(v))
+	}
+	copy(ih[:], v)
+	return ih, nil
+}
+
+// Build the announcing peer from the request parameters.
+// The address is taken from the connection, not from the client.
+func parsePeer(q url.Values, remoteAddr string) (*peer, error) {
+	if len(q.Get("peer_id")) != 20 {
+		return nil, fmt.Errorf("invalid peer_id")
+	}
+
+	port, err := strconv.Atoi(q.Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %q", q.Get("port"))
+	}
+
+	left, err := strconv.ParseInt(q.Get("left"), 10, 64)
+	if err != nil || left < 0 {
+		return nil, fmt.Errorf("invalid left %q", q.Get("left"))
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return &peer{
+		ID:       q.Get("peer_id"),
+		IP:       ip,
+		Port:     port,
+		Left:     left,
+		LastSeen: time.Now(),
+	}, nil
+}
+
+// Encode peers in the compact format (BEP 23), IPv6 peers go to `peers6`.
+func compactPeers(picked []*peer) (bencode.RawMessage, []byte) {
+	var v4, v6 []byte
+	for _, p := range picked {
+		if ip4 := p.IP.To4(); ip4 != nil {
+			v4 = binary.BigEndian.AppendUint16(append(v4, ip4...), uint16(p.Port))
+		} else {
+			v6 = binary.BigEndian.AppendUint16(append(v6, p.IP.To16()...), uint16(p.Port))
+		}
+	}
+
+	peers, _ := bencode.Marshal(v4)
+	return peers, v6
+}
+
+func dictPeers(picked []*peer, noPeerID bool) (bencode.RawMessage, error) {
+	list := []peerDict{}
+	for _, p := range picked {
+		d := peerDict{IP: p.IP.String(), Port: p.Port}
+		if !noPeerID {
+			d.PeerID = p.ID
+		}
+		list = append(list, d)
+	}
+	return bencode.Marshal(list)
+}
+
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeResponse(w, struct {
+		FailureReason string `bencode:"failure reason"`
+	}{reason})
+}
+
+func writeResponse(w http.ResponseWriter, v any) {
+	data, err := bencode.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
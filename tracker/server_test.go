@@ -0,0 +1,113 @@
+package tracker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestExpireDropsEmptySwarms(t *testing.T) {
+	s := NewServer()
+	s.PeerTTL = time.Minute
+
+	stale, live := hash{1}, hash{2}
+	for _, ih := range []hash{stale, live} {
+		s.swarms[ih] = newSwarm()
+	}
+	s.swarms[stale].peers[peerKey{"a", "10.0.0.1"}] = &peer{ID: "a", IP: net.IPv4(10, 0, 0, 1), Port: 1, LastSeen: time.Now().Add(-time.Hour)}
+	s.swarms[live].peers[peerKey{"b", "10.0.0.2"}] = &peer{ID: "b", IP: net.IPv4(10, 0, 0, 2), Port: 2, LastSeen: time.Now()}
+
+	s.expire()
+
+	if _, ok := s.swarms[stale]; ok {
+		t.Error("swarm with only expired peers was kept")
+	}
+	if sw, ok := s.swarms[live]; !ok || len(sw.peers) != 1 {
+		t.Error("swarm with a live peer was dropped")
+	}
+}
+
+// Announce `infoHash` to the server as `peerID`, connecting from `ip`.
+func announceFrom(s *Server, infoHash hash, peerID, ip, event string) {
+	q := url.Values{
+		"info_hash": {string(infoHash[:])},
+		"peer_id":   {peerID},
+		"port":      {"6881"},
+		"left":      {"100"},
+		"event":     {event},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/announce?"+q.Encode(), nil)
+	r.RemoteAddr = ip + ":40000"
+	s.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestAnnounceSpoofedPeerID(t *testing.T) {
+	s := NewServer()
+	ih := hash{1}
+	victim := "-TRLY01-victim000001"
+
+	announceFrom(s, ih, victim, "10.0.0.1", "started")
+
+	// Someone else reusing the peer ID can neither stop nor move the peer
+	announceFrom(s, ih, victim, "10.0.0.2", "stopped")
+	announceFrom(s, ih, victim, "10.0.0.3", "started")
+
+	p, ok := s.swarms[ih].peers[peerKey{victim, "10.0.0.1"}]
+	if !ok {
+		t.Fatal("peer was removed by a stopped event from another address")
+	}
+	if !p.IP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("peer address = %v, want 10.0.0.1", p.IP)
+	}
+
+	// The peer itself still can
+	announceFrom(s, ih, victim, "10.0.0.1", "stopped")
+	if _, ok := s.swarms[ih].peers[peerKey{victim, "10.0.0.1"}]; ok {
+		t.Error("peer is still there after its own stopped event")
+	}
+}
+
+func TestAnnounceCaps(t *testing.T) {
+	s := NewServer()
+	start := time.Now().Add(-time.Minute)
+
+	// As many swarms as allowed, the first one announced to longest ago
+	for i := 0; i < maxSwarms; i++ {
+		sw := newSwarm()
+		p := &peer{ID: "a", IP: net.IPv4(10, 0, 0, 1), Port: 1, LastSeen: start.Add(time.Duration(i) * time.Millisecond)}
+		sw.peers[p.key()] = p
+		s.swarms[hash{byte(i >> 8), byte(i)}] = sw
+	}
+
+	announceFrom(s, hash{0xff, 0xff}, "-TRLY01-newcomer0001", "10.0.0.2", "started")
+
+	if len(s.swarms) != maxSwarms {
+		t.Errorf("tracker has %d swarms, want %d", len(s.swarms), maxSwarms)
+	}
+	if _, ok := s.swarms[hash{0, 0}]; ok {
+		t.Error("the least recently announced swarm was kept")
+	}
+
+	// A swarm full of peers announced from a single host
+	sw := s.swarms[hash{0, 1}]
+	for i := len(sw.peers); i < maxPeersPerSwarm; i++ {
+		p := &peer{ID: fmt.Sprintf("peer%016d", i), IP: net.IPv4(10, 0, 0, 3), Port: 1, LastSeen: time.Now()}
+		sw.peers[p.key()] = p
+	}
+
+	announceFrom(s, hash{0, 1}, "-TRLY01-newcomer0001", "10.0.0.2", "started")
+
+	if len(sw.peers) != maxPeersPerSwarm {
+		t.Errorf("swarm has %d peers, want %d", len(sw.peers), maxPeersPerSwarm)
+	}
+	if _, ok := sw.peers[peerKey{"a", "10.0.0.1"}]; ok {
+		t.Error("the peer that announced least recently was kept")
+	}
+	if _, ok := sw.peers[peerKey{"-TRLY01-newcomer0001", "10.0.0.2"}]; !ok {
+		t.Error("the new peer was not added")
+	}
+}
@@ -0,0 +1,101 @@
+package tracker
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// A peer as last announced to the tracker.
+type peer struct {
+	ID       string
+	IP       net.IP
+	Port     int
+	Left     int64 // Bytes the peer still needs, 0 for seeders
+	LastSeen time.Time
+}
+
+// Peers are told apart by peer ID and address, so a client can't stop or
+// replace another peer by sending its peer ID.
+type peerKey struct {
+	id string
+	ip string
+}
+
+func (p *peer) key() peerKey {
+	return peerKey{id: p.ID, ip: p.IP.String()}
+}
+
+// swarm holds the peers of a single torrent. Callers MUST hold Server.mu.
+type swarm struct {
+	peers      map[peerKey]*peer
+	downloaded int // Number of `completed` events received
+}
+
+func newSwarm() *swarm {
+	return &swarm{peers: map[peerKey]*peer{}}
+}
+
+// Drop the peers that haven't announced within `ttl`.
+func (s *swarm) expire(ttl time.Duration) {
+	deadline := time.Now().Add(-ttl)
+	for key, p := range s.peers {
+		if p.LastSeen.Before(deadline) {
+			delete(s.peers, key)
+		}
+	}
+}
+
+// Make room for another peer by dropping the one that announced least recently.
+func (s *swarm) evict() {
+	var (
+		oldest peerKey
+		found  bool
+	)
+	for key, p := range s.peers {
+		if !found || p.LastSeen.Before(s.peers[oldest].LastSeen) {
+			oldest, found = key, true
+		}
+	}
+	delete(s.peers, oldest)
+}
+
+// When a peer last announced to the swarm.
+func (s *swarm) lastSeen() time.Time {
+	latest := time.Time{}
+	for _, p := range s.peers {
+		if p.LastSeen.After(latest) {
+			latest = p.LastSeen
+		}
+	}
+	return latest
+}
+
+// Number of seeders and leechers in the swarm.
+func (s *swarm) counts() (complete, incomplete int) {
+	for _, p := range s.peers {
+		if p.Left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return complete, incomplete
+}
+
+// Pick up to `n` random peers other than `self`.
+// Seeders don't get other seeders, they have nothing to gain from them.
+func (s *swarm) pick(n int, self *peer) []*peer {
+	picked := []*peer{}
+	for key, p := range s.peers {
+		if key == self.key() || (self.Left == 0 && p.Left == 0) {
+			continue
+		}
+		picked = append(picked, p)
+	}
+
+	rand.Shuffle(len(picked), func(i, j int) {
+		picked[i], picked[j] = picked[j], picked[i]
+	})
+	return picked[:min(n, len(picked))]
+}